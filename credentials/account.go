@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// AccountKind is the kind of an account, which decides how the tokens are
+// obtained.
+type AccountKind string
+
+const (
+	// AccountKindGcloud is the default account of gcloud.
+	AccountKindGcloud AccountKind = "gcloud"
+	// AccountKindUser is an account registered in gcloud with `gcloud auth
+	// login`. The value is its email.
+	AccountKindUser AccountKind = "user"
+	// AccountKindServiceAccount is a service account impersonated with IAM
+	// Service Account Credentials API. The value is its email.
+	AccountKindServiceAccount AccountKind = "sa"
+	// AccountKindApplicationDefault is the application default credentials.
+	AccountKindApplicationDefault AccountKind = "adc"
+	// AccountKindExternalAccount is Workload Identity Federation.
+	AccountKindExternalAccount AccountKind = "external-account"
+	// AccountKindMetadata is a service account of the GCE metadata server.
+	// The value is its email or alias. If empty, it's `default`.
+	AccountKindMetadata AccountKind = "metadata"
+	// AccountKindKeyFile is a service account JSON key. The value is the
+	// path to the key.
+	AccountKindKeyFile AccountKind = "keyfile"
+	// AccountKindExec is an external command. The value is the command.
+	AccountKindExec AccountKind = "exec"
+)
+
+const (
+	accountApplicationDefault = "application-default"
+	accountExternalAccount    = "external-account"
+	accountGcloud             = "gcloud"
+	accountMetadata           = "metadata"
+
+	accountUserPrefix           = "user:"
+	accountServiceAccountPrefix = "sa:"
+)
+
+// Account is a parsed value of google.account.
+type Account struct {
+	Kind AccountKind
+	// Value depends on the kind. See the AccountKind constants.
+	Value string
+}
+
+// String returns the account in the explicit prefix form, which ParseAccount
+// parses back to the same Account.
+func (a Account) String() string {
+	switch a.Kind {
+	case AccountKindGcloud, AccountKindApplicationDefault, AccountKindExternalAccount:
+		return string(a.Kind)
+	case AccountKindMetadata:
+		if a.Value == "" {
+			return accountMetadata
+		}
+	}
+	return string(a.Kind) + ":" + a.Value
+}
+
+// ParseAccount parses an account in google.account. In addition to the
+// explicit forms such as `user:EMAIL` and `sa:EMAIL`, a bare email is taken as
+// a service account if it ends with `.gserviceaccount.com`, or as a gcloud
+// account otherwise.
+func ParseAccount(s string) (Account, error) {
+	s = strings.TrimSpace(s)
+	valued := func(kind AccountKind, prefix string) (Account, error) {
+		v := strings.TrimSpace(strings.TrimPrefix(s, prefix))
+		if v == "" {
+			return Account{}, xerrors.Errorf("credentials: account %q needs a value after %q", s, prefix)
+		}
+		return Account{Kind: kind, Value: v}, nil
+	}
+	email := func(kind AccountKind, prefix string) (Account, error) {
+		a, err := valued(kind, prefix)
+		if err == nil && !isEmail(a.Value) {
+			return Account{}, xerrors.Errorf("credentials: %q in account %q is not an email", a.Value, s)
+		}
+		return a, err
+	}
+
+	switch {
+	case s == "" || s == accountGcloud:
+		return Account{Kind: AccountKindGcloud}, nil
+	case s == string(AccountKindApplicationDefault) || s == accountApplicationDefault:
+		return Account{Kind: AccountKindApplicationDefault}, nil
+	case s == accountExternalAccount:
+		return Account{Kind: AccountKindExternalAccount}, nil
+	case s == accountMetadata:
+		return Account{Kind: AccountKindMetadata}, nil
+	case strings.HasPrefix(s, accountMetadata+":"):
+		return valued(AccountKindMetadata, accountMetadata+":")
+	case strings.HasPrefix(s, accountKeyFilePrefix):
+		return valued(AccountKindKeyFile, accountKeyFilePrefix)
+	case strings.HasPrefix(s, accountExecPrefix):
+		return valued(AccountKindExec, accountExecPrefix)
+	case strings.HasPrefix(s, accountUserPrefix):
+		return email(AccountKindUser, accountUserPrefix)
+	case strings.HasPrefix(s, accountServiceAccountPrefix):
+		return email(AccountKindServiceAccount, accountServiceAccountPrefix)
+	case isEmail(s) && strings.HasSuffix(s, ".gserviceaccount.com"):
+		return Account{Kind: AccountKindServiceAccount, Value: s}, nil
+	case isEmail(s):
+		return Account{Kind: AccountKindUser, Value: s}, nil
+	}
+	return Account{}, xerrors.Errorf("credentials: unknown account %q. Use gcloud, adc, external-account, metadata, metadata:SERVICE_ACCOUNT, user:EMAIL, sa:EMAIL, keyfile:PATH or exec:COMMAND", s)
+}
+
+// ParseAccounts parses a comma separated list of accounts. Since a command
+// can contain commas, an `exec:` account takes the rest of the list. If the
+// list is empty, it returns the gcloud account.
+func ParseAccounts(s string) ([]Account, error) {
+	var accounts []Account
+	for s != "" {
+		s = strings.TrimSpace(s)
+		i := strings.Index(s, ",")
+		if i < 0 || strings.HasPrefix(s, accountExecPrefix) {
+			i = len(s)
+		}
+		if v := strings.TrimSpace(s[:i]); v != "" {
+			a, err := ParseAccount(v)
+			if err != nil {
+				return nil, err
+			}
+			accounts = append(accounts, a)
+		}
+		if i == len(s) {
+			break
+		}
+		s = s[i+1:]
+	}
+	if len(accounts) == 0 {
+		return []Account{{Kind: AccountKindGcloud}}, nil
+	}
+	return accounts, nil
+}
+
+func isEmail(s string) bool {
+	i := strings.Index(s, "@")
+	return i > 0 && i < len(s)-1 && strings.Count(s, "@") == 1 && !strings.ContainsAny(s, " \t,:")
+}
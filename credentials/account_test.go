@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAccount(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    Account
+		wantErr bool
+	}{
+		{in: "", want: Account{Kind: AccountKindGcloud}},
+		{in: "gcloud", want: Account{Kind: AccountKindGcloud}},
+		{in: "adc", want: Account{Kind: AccountKindApplicationDefault}},
+		{in: "application-default", want: Account{Kind: AccountKindApplicationDefault}},
+		{in: "external-account", want: Account{Kind: AccountKindExternalAccount}},
+		{in: "metadata", want: Account{Kind: AccountKindMetadata}},
+		{in: "metadata:builder", want: Account{Kind: AccountKindMetadata, Value: "builder"}},
+		{in: "keyfile:/etc/key.json", want: Account{Kind: AccountKindKeyFile, Value: "/etc/key.json"}},
+		{in: "exec:broker --host %h", want: Account{Kind: AccountKindExec, Value: "broker --host %h"}},
+		{in: "user:me@example.com", want: Account{Kind: AccountKindUser, Value: "me@example.com"}},
+		{in: "sa:bot@example.com", want: Account{Kind: AccountKindServiceAccount, Value: "bot@example.com"}},
+		// gcloud can hold service account keys, too.
+		{in: "user:bot@p.iam.gserviceaccount.com", want: Account{Kind: AccountKindUser, Value: "bot@p.iam.gserviceaccount.com"}},
+		// The heuristics for the backward compatibility.
+		{in: "me@example.com", want: Account{Kind: AccountKindUser, Value: "me@example.com"}},
+		{in: "bot@p.iam.gserviceaccount.com", want: Account{Kind: AccountKindServiceAccount, Value: "bot@p.iam.gserviceaccount.com"}},
+		{in: "application_default", wantErr: true},
+		{in: "gcloud:me@example.com", wantErr: true},
+		{in: "user:me", wantErr: true},
+		{in: "keyfile:", wantErr: true},
+	} {
+		got, err := ParseAccount(tc.in)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("ParseAccount(%q): got error %v, want error: %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseAccount(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+		// String returns the form that is parsed back to the same.
+		if again, err := ParseAccount(got.String()); err != nil || again != got {
+			t.Errorf("ParseAccount(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+		}
+	}
+}
+
+func TestParseAccounts(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: []string{"gcloud"}},
+		{in: "gcloud, application-default,metadata", want: []string{"gcloud", "adc", "metadata"}},
+		{in: "gcloud,,metadata,", want: []string{"gcloud", "metadata"}},
+		{in: "metadata, exec:broker --scopes a,b", want: []string{"metadata", "exec:broker --scopes a,b"}},
+		{in: "gcloud, application_default", wantErr: true},
+	} {
+		accounts, err := ParseAccounts(tc.in)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("ParseAccounts(%q): got error %v, want error: %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		var got []string
+		for _, a := range accounts {
+			got = append(got, a.String())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseAccounts(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
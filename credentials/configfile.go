@@ -0,0 +1,679 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// maxIncludeDepth is the limit of nested includes, same as git.
+const maxIncludeDepth = 10
+
+// readGitConfigFiles reads git-config without git. The files are read in the
+// same order as git: the system config, the XDG config, ~/.gitconfig, the
+// config of the repository at dir (or GIT_DIR), then the configs in
+// GIT_CONFIG_COUNT, GIT_CONFIG_PARAMETERS and configs, which are in the form
+// of `git -c`. If dir is empty, the current directory is used.
+func readGitConfigFiles(dir string, configs []string) (*GitConfigSnapshot, error) {
+	gitDir, err := findGitDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &gitConfigReader{snapshot: &GitConfigSnapshot{}, gitDir: gitDir}
+
+	for _, path := range globalGitConfigFiles() {
+		if err := r.readFile(path, 0); err != nil {
+			return nil, err
+		}
+	}
+	if gitDir != "" {
+		commonDir := gitDir
+		if bs, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+			commonDir = strings.TrimSpace(string(bs))
+			if !filepath.IsAbs(commonDir) {
+				commonDir = filepath.Join(gitDir, commonDir)
+			}
+		}
+		if err := r.readFile(filepath.Join(commonDir, "config"), 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.readEnv(); err != nil {
+		return nil, err
+	}
+	for _, c := range configs {
+		if err := r.addParameter(c); err != nil {
+			return nil, err
+		}
+	}
+	return r.snapshot, nil
+}
+
+// globalGitConfigFiles returns the system and global git-config files.
+func globalGitConfigFiles() []string {
+	var files []string
+	if nosystem, _ := parseGitBool(os.Getenv("GIT_CONFIG_NOSYSTEM")); !nosystem {
+		if p := os.Getenv("GIT_CONFIG_SYSTEM"); p != "" {
+			files = append(files, p)
+		} else if runtime.GOOS == "windows" {
+			if d := os.Getenv("ProgramFiles"); d != "" {
+				files = append(files, filepath.Join(d, "Git", "etc", "gitconfig"))
+			}
+		} else {
+			files = append(files, "/etc/gitconfig")
+		}
+	}
+
+	if p := os.Getenv("GIT_CONFIG_GLOBAL"); p != "" {
+		return append(files, p)
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		home, _ = os.UserHomeDir()
+	}
+	if d := os.Getenv("XDG_CONFIG_HOME"); d != "" {
+		files = append(files, filepath.Join(d, "git", "config"))
+	} else if home != "" {
+		files = append(files, filepath.Join(home, ".config", "git", "config"))
+	}
+	if home != "" {
+		files = append(files, filepath.Join(home, ".gitconfig"))
+	}
+	return files
+}
+
+// findGitDir returns the absolute path to the git directory of the repository
+// containing dir, or GIT_DIR if it's set. A relative GIT_DIR is relative to
+// dir as git runs in dir. It returns empty if dir is not in a repository.
+func findGitDir(dir string) (string, error) {
+	if dir != "" {
+		if fi, err := os.Stat(dir); err != nil {
+			return "", xerrors.Errorf("credentials: cannot find the repository: %w", err)
+		} else if !fi.IsDir() {
+			return "", xerrors.Errorf("credentials: %s is not a directory", dir)
+		}
+	}
+	if d := os.Getenv("GIT_DIR"); d != "" {
+		if !filepath.IsAbs(d) {
+			d = filepath.Join(dir, d)
+		}
+		return filepath.Abs(d)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", xerrors.Errorf("credentials: cannot find the repository: %w", err)
+	}
+	for {
+		p := filepath.Join(dir, ".git")
+		if fi, err := os.Stat(p); err == nil {
+			if fi.IsDir() {
+				return p, nil
+			}
+			// A worktree or a submodule has a file pointing to the git
+			// directory.
+			bs, err := ioutil.ReadFile(p)
+			if err != nil {
+				return "", xerrors.Errorf("credentials: cannot read %s: %w", p, err)
+			}
+			s := strings.TrimSpace(string(bs))
+			if !strings.HasPrefix(s, "gitdir:") {
+				return "", xerrors.Errorf("credentials: invalid gitfile format: %s", p)
+			}
+			d := strings.TrimSpace(strings.TrimPrefix(s, "gitdir:"))
+			if !filepath.IsAbs(d) {
+				d = filepath.Join(dir, d)
+			}
+			return d, nil
+		}
+		if isGitDir(dir) {
+			// A bare repository, or the git directory itself.
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// isGitDir reports whether dir looks like a git directory, in the same way as
+// git's repository discovery.
+func isGitDir(dir string) bool {
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || fi.IsDir() {
+		return false
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "objects")); err != nil || !fi.IsDir() {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(dir, "refs"))
+	return err == nil && fi.IsDir()
+}
+
+// gitConfigReader reads git-config files into a snapshot.
+type gitConfigReader struct {
+	snapshot *GitConfigSnapshot
+	// gitDir is used for `includeIf "gitdir:..."`. This is empty outside
+	// repositories.
+	gitDir string
+}
+
+// readFile reads a config file. A missing file is ignored as git does.
+func (r *gitConfigReader) readFile(path string, depth int) error {
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("credentials: cannot read %s: %w", path, err)
+	}
+	return parseGitConfigFile(string(bs), func(e gitConfigEntry) error {
+		e.origin = "file:" + path
+		r.snapshot.entries = append(r.snapshot.entries, e)
+		include, err := r.includePath(e, filepath.Dir(path))
+		if err != nil || include == "" {
+			return err
+		}
+		if depth+1 > maxIncludeDepth {
+			return xerrors.Errorf("credentials: exceeded the maximum include depth at %s", path)
+		}
+		return r.readFile(include, depth+1)
+	})
+}
+
+// includePath returns the file to include for `include.path` and
+// `includeIf.CONDITION.path`, or empty if the entry doesn't include a file.
+// A relative path is relative to dir, the directory of the including file.
+func (r *gitConfigReader) includePath(e gitConfigEntry, dir string) (string, error) {
+	if e.name != "path" || e.noValue {
+		return "", nil
+	}
+	switch {
+	case e.section == "include" && e.subsection == "":
+	case e.section == "includeif" && r.includeCondition(e.subsection, dir):
+	default:
+		return "", nil
+	}
+	p, err := expandGitPath(e.value)
+	if err != nil {
+		return "", xerrors.Errorf("credentials: cannot expand the include path %q: %w", e.value, err)
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	return p, nil
+}
+
+// includeCondition evaluates the condition of `includeIf`. Only `gitdir:`,
+// `gitdir/i:` and `onbranch:` are supported. The others never match.
+func (r *gitConfigReader) includeCondition(cond, dir string) bool {
+	if r.gitDir == "" {
+		return false
+	}
+	var pattern string
+	icase := false
+	switch {
+	case strings.HasPrefix(cond, "gitdir:"):
+		pattern = strings.TrimPrefix(cond, "gitdir:")
+	case strings.HasPrefix(cond, "gitdir/i:"):
+		pattern, icase = strings.TrimPrefix(cond, "gitdir/i:"), true
+	case strings.HasPrefix(cond, "onbranch:"):
+		pattern = strings.TrimPrefix(cond, "onbranch:")
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		bs, err := ioutil.ReadFile(filepath.Join(r.gitDir, "HEAD"))
+		if err != nil {
+			return false
+		}
+		head := strings.TrimSpace(string(bs))
+		if !strings.HasPrefix(head, "ref: refs/heads/") {
+			return false
+		}
+		return wildmatch(pattern, strings.TrimPrefix(head, "ref: refs/heads/"), false)
+	default:
+		return false
+	}
+
+	if p, err := expandGitPath(pattern); err == nil {
+		pattern = p
+	}
+	pattern = filepath.ToSlash(pattern)
+	if strings.HasPrefix(pattern, "./") {
+		pattern = filepath.ToSlash(dir) + pattern[1:]
+	}
+	if !strings.HasPrefix(pattern, "/") && !filepath.IsAbs(filepath.FromSlash(pattern)) {
+		pattern = "**/" + pattern
+	}
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	if wildmatch(pattern, filepath.ToSlash(r.gitDir), icase) {
+		return true
+	}
+	real, err := filepath.EvalSymlinks(r.gitDir)
+	return err == nil && wildmatch(pattern, filepath.ToSlash(real), icase)
+}
+
+// wildmatch matches a path with a glob pattern, where `*` doesn't match `/`,
+// and `**` matches across directories.
+func wildmatch(pattern, name string, icase bool) bool {
+	var b strings.Builder
+	b.WriteString("^")
+	if icase {
+		b.WriteString("(?i)")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j < 0 {
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	return err == nil && re.MatchString(name)
+}
+
+// readEnv reads the configs in GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n> and
+// GIT_CONFIG_VALUE_<n>, then GIT_CONFIG_PARAMETERS, which is how git passes
+// `-c` to subprocesses.
+func (r *gitConfigReader) readEnv() error {
+	if s := os.Getenv("GIT_CONFIG_COUNT"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return xerrors.Errorf("credentials: bogus GIT_CONFIG_COUNT %q", s)
+		}
+		for i := 0; i < n; i++ {
+			key, ok := os.LookupEnv("GIT_CONFIG_KEY_" + strconv.Itoa(i))
+			if !ok {
+				return xerrors.Errorf("credentials: missing GIT_CONFIG_KEY_%d", i)
+			}
+			value, ok := os.LookupEnv("GIT_CONFIG_VALUE_" + strconv.Itoa(i))
+			if !ok {
+				return xerrors.Errorf("credentials: missing GIT_CONFIG_VALUE_%d", i)
+			}
+			if err := r.addCommandLine(key, value, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	params, err := splitSingleQuoted(os.Getenv("GIT_CONFIG_PARAMETERS"))
+	if err != nil {
+		return err
+	}
+	for _, p := range params {
+		if p.hasValue {
+			// `'KEY'='VALUE'` of Git 2.31 and later.
+			err = r.addCommandLine(p.key, p.value, false)
+		} else {
+			// `'KEY=VALUE'` of the older versions.
+			err = r.addParameter(p.key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addParameter adds a config in the form of `git -c KEY=VALUE`. A config
+// without `=` is true as a boolean.
+func (r *gitConfigReader) addParameter(s string) error {
+	return r.snapshot.addParameter("command line:", s)
+}
+
+func (r *gitConfigReader) addCommandLine(key, value string, noValue bool) error {
+	return r.snapshot.add("command line:", key, value, noValue)
+}
+
+type configParameter struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+// splitSingleQuoted splits GIT_CONFIG_PARAMETERS, which is a list of shell
+// single-quoted strings separated by spaces. A string directly followed by
+// `=` and another string is a key-value pair.
+func splitSingleQuoted(s string) ([]configParameter, error) {
+	var params []configParameter
+	next := func() (string, error) {
+		var b strings.Builder
+		for len(s) > 0 && s[0] == '\'' {
+			i := strings.IndexByte(s[1:], '\'')
+			if i < 0 {
+				return "", xerrors.New("credentials: bogus format in GIT_CONFIG_PARAMETERS")
+			}
+			b.WriteString(s[1 : i+1])
+			s = s[i+2:]
+			// `'\''` is an escaped quote.
+			if strings.HasPrefix(s, `\'`) {
+				b.WriteByte('\'')
+				s = s[2:]
+			}
+		}
+		return b.String(), nil
+	}
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return params, nil
+		}
+		if s[0] != '\'' {
+			return nil, xerrors.New("credentials: bogus format in GIT_CONFIG_PARAMETERS")
+		}
+		key, err := next()
+		if err != nil {
+			return nil, err
+		}
+		p := configParameter{key: key}
+		if strings.HasPrefix(s, "=") {
+			s = s[1:]
+			if p.value, err = next(); err != nil {
+				return nil, err
+			}
+			p.hasValue = true
+		}
+		params = append(params, p)
+	}
+}
+
+// parseGitConfigFile parses the content of a git-config file, and calls f for
+// each entry in order. The origin of the entries is not set, but the line
+// number is.
+func parseGitConfigFile(data string, f func(gitConfigEntry) error) error {
+	data = strings.TrimPrefix(data, "\ufeff")
+	data = strings.Replace(data, "\r\n", "\n", -1)
+	p := &gitConfigFileParser{data: data, line: 1}
+	var section, subsection string
+	for p.i < len(p.data) {
+		c := p.data[p.i]
+		switch {
+		case c == '\n':
+			p.line++
+			p.i++
+		case c == ' ' || c == '\t' || c == '\r':
+			p.i++
+		case c == '#' || c == ';':
+			p.skipLine()
+		case c == '[':
+			var err error
+			section, subsection, err = p.parseSectionHeader()
+			if err != nil {
+				return err
+			}
+		case isAlpha(c):
+			if section == "" {
+				return p.errorf("a config outside a section")
+			}
+			e, err := p.parseEntry()
+			if err != nil {
+				return err
+			}
+			e.section, e.subsection = section, subsection
+			if err := f(e); err != nil {
+				return err
+			}
+		default:
+			return p.errorf("unexpected character %q", c)
+		}
+	}
+	return nil
+}
+
+type gitConfigFileParser struct {
+	data string
+	i    int
+	line int
+}
+
+func (p *gitConfigFileParser) errorf(format string, args ...interface{}) error {
+	return xerrors.Errorf("credentials: bad config line %d: "+format, append([]interface{}{p.line}, args...)...)
+}
+
+func (p *gitConfigFileParser) skipLine() {
+	for p.i < len(p.data) && p.data[p.i] != '\n' {
+		p.i++
+	}
+}
+
+// parseSectionHeader parses `[SECTION]`, `[SECTION "SUBSECTION"]`, or the
+// deprecated `[SECTION.SUBSECTION]`.
+func (p *gitConfigFileParser) parseSectionHeader() (section, subsection string, err error) {
+	p.i++
+	start := p.i
+	for p.i < len(p.data) && (isKeyChar(p.data[p.i]) || p.data[p.i] == '.') {
+		p.i++
+	}
+	section = strings.ToLower(p.data[start:p.i])
+	if section == "" {
+		return "", "", p.errorf("empty section name")
+	}
+	if i := strings.IndexByte(section, '.'); i >= 0 {
+		section, subsection = section[:i], section[i+1:]
+	}
+	for p.i < len(p.data) && (p.data[p.i] == ' ' || p.data[p.i] == '\t') {
+		p.i++
+	}
+	if p.i < len(p.data) && p.data[p.i] == '"' && subsection == "" {
+		p.i++
+		var b strings.Builder
+		for {
+			if p.i >= len(p.data) || p.data[p.i] == '\n' {
+				return "", "", p.errorf("unterminated subsection")
+			}
+			c := p.data[p.i]
+			p.i++
+			if c == '"' {
+				break
+			}
+			if c == '\\' && p.i < len(p.data) && p.data[p.i] != '\n' {
+				c = p.data[p.i]
+				p.i++
+			}
+			b.WriteByte(c)
+		}
+		subsection = b.String()
+	}
+	if p.i >= len(p.data) || p.data[p.i] != ']' {
+		return "", "", p.errorf("invalid section header")
+	}
+	p.i++
+	return section, subsection, nil
+}
+
+// parseEntry parses `NAME = VALUE` or `NAME`.
+func (p *gitConfigFileParser) parseEntry() (gitConfigEntry, error) {
+	start := p.i
+	for p.i < len(p.data) && isKeyChar(p.data[p.i]) {
+		p.i++
+	}
+	e := gitConfigEntry{name: strings.ToLower(p.data[start:p.i]), line: p.line}
+	for p.i < len(p.data) && (p.data[p.i] == ' ' || p.data[p.i] == '\t' || p.data[p.i] == '\r') {
+		p.i++
+	}
+	if p.i >= len(p.data) || p.data[p.i] == '\n' || p.data[p.i] == '#' || p.data[p.i] == ';' {
+		e.noValue = true
+		p.skipLine()
+		return e, nil
+	}
+	if p.data[p.i] != '=' {
+		return e, p.errorf("invalid config name")
+	}
+	p.i++
+	var err error
+	e.value, err = p.parseValue()
+	return e, err
+}
+
+// parseValue parses a value. Like git, the spaces around the value are
+// trimmed, the double quotes are removed, and the escapes are interpreted. A
+// backslash at the end of a line continues the value.
+func (p *gitConfigFileParser) parseValue() (string, error) {
+	var b strings.Builder
+	quote, comment := false, false
+	spaces := 0
+	for p.i < len(p.data) {
+		c := p.data[p.i]
+		if c == '\n' {
+			break
+		}
+		p.i++
+		if comment {
+			continue
+		}
+		if (c == ' ' || c == '\t' || c == '\r') && !quote {
+			if b.Len() > 0 {
+				spaces++
+			}
+			continue
+		}
+		if !quote && (c == '#' || c == ';') {
+			comment = true
+			continue
+		}
+		for ; spaces > 0; spaces-- {
+			b.WriteByte(' ')
+		}
+		switch c {
+		case '\\':
+			if p.i >= len(p.data) {
+				return "", p.errorf("incomplete escape")
+			}
+			c = p.data[p.i]
+			p.i++
+			switch c {
+			case '\n':
+				p.line++
+				continue
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'n':
+				c = '\n'
+			case '\\', '"':
+			default:
+				return "", p.errorf("invalid escape \\%c", c)
+			}
+			b.WriteByte(c)
+		case '"':
+			quote = !quote
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quote {
+		return "", p.errorf("unterminated quote")
+	}
+	return b.String(), nil
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isKeyChar(c byte) bool {
+	return isAlpha(c) || ('0' <= c && c <= '9') || c == '-'
+}
+
+// fileConfigAccessor reads the git-config files without git for each config.
+// This is used when git is not available.
+type fileConfigAccessor struct {
+	gitBinary GitBinary
+	u         *url.URL
+	// profileOverride is passed to snapshotAccessor.
+	profileOverride *string
+}
+
+func (a fileConfigAccessor) withProfile(profile string) GitConfigAccessor {
+	a.profileOverride = &profile
+	return a
+}
+
+func (a fileConfigAccessor) accessor() (GitConfigAccessor, error) {
+	s, err := readGitConfigFiles(a.gitBinary.Dir, a.gitBinary.Configs)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotAccessor{snapshot: s, u: a.u, profileOverride: a.profileOverride}, nil
+}
+
+func (a fileConfigAccessor) BoolConfig(ctx context.Context, key string) (bool, error) {
+	g, err := a.accessor()
+	if err != nil {
+		return false, err
+	}
+	return g.BoolConfig(ctx, key)
+}
+
+func (a fileConfigAccessor) PathConfig(ctx context.Context, key string) (string, error) {
+	g, err := a.accessor()
+	if err != nil {
+		return "", err
+	}
+	return g.PathConfig(ctx, key)
+}
+
+func (a fileConfigAccessor) StringConfig(ctx context.Context, key string) (string, error) {
+	g, err := a.accessor()
+	if err != nil {
+		return "", err
+	}
+	return g.StringConfig(ctx, key)
+}
+
+func (a fileConfigAccessor) StringListConfig(ctx context.Context, key string) ([]string, error) {
+	g, err := a.accessor()
+	if err != nil {
+		return nil, err
+	}
+	return g.StringListConfig(ctx, key)
+}
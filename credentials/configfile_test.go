@@ -0,0 +1,239 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const includingGitConfig = `# A comment
+[include]
+	path = included.gitconfig
+[includeIf "gitdir:~/work/"]
+	path = ~/work.gitconfig
+[includeIf "gitdir:/nonexistent/"]
+	path = never.gitconfig
+[includeIf "onbranch:main"]
+	path = branch.gitconfig
+[google]
+	account = "quoted ; not a comment"  ; a comment
+	scopes = a,\
+b
+	escaped = tab\there \"quoted\"  with  spaces
+	flag
+[google "https://sub\"section\\.example.com"]
+	account = escaped@example.com
+[google.Deprecated-Section]
+	account = deprecated@example.com
+[GOOGLE "https://Case.example.com"]
+	ACCOUNT = case@example.com
+`
+
+func TestReadGitConfigFiles(t *testing.T) {
+	g, _ := FindGitBinary()
+	if g.Path == "" {
+		t.Skip("requires git to compare with")
+	}
+	home, restore := setGitConfigEnv(t, includingGitConfig)
+	defer restore()
+	files := map[string]string{
+		"included.gitconfig":    "[google]\n\tincluded = true\n",
+		"work.gitconfig":        "[google \"https://work.example.com\"]\n\taccount = work@example.com\n",
+		"never.gitconfig":       "[google]\n\tnever = true\n",
+		"branch.gitconfig":      "[google]\n\tbranch = main\n",
+		".config/git/config":    "[google]\n\taccount = xdg@example.com\n",
+		"work/repo/placeholder": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(home, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := filepath.Join(home, "work", "repo")
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"config", "google.account", "repo@example.com"},
+	} {
+		cmd := exec.Command(g.Path, args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %q: %v\n%s", args, err, out)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]string{
+		"GIT_CONFIG_COUNT":      "1",
+		"GIT_CONFIG_KEY_0":      "google.https://env.example.com.account",
+		"GIT_CONFIG_VALUE_0":    "env@example.com",
+		"GIT_CONFIG_PARAMETERS": `'google.old=it'\''s' 'google.new'='new' 'google.novalue'`,
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	g.Configs = []string{"google.cli=cli", "google.cliflag"}
+
+	want, err := g.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	got, err := GitBinary{Configs: g.Configs}.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Snapshot without git: %v", err)
+	}
+	// The line numbers of the entries read by git are filled by parsing the
+	// files in Go.
+	want.fillLines()
+	if !reflect.DeepEqual(withoutOrigin(got.entries), withoutOrigin(want.entries)) {
+		t.Errorf("got entries\n%+v\ngit returns\n%+v", withoutOrigin(got.entries), withoutOrigin(want.entries))
+	}
+	for key, want := range map[string]string{
+		"google.included": "true",
+		"google.branch":   "main",
+		"google.never":    "",
+		"google.account":  "repo@example.com",
+	} {
+		if v, err := got.StringConfig(context.Background(), key); err != nil || v != want {
+			t.Errorf("StringConfig(%s) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+	if v, _ := got.WithURL(&url.URL{Scheme: "https", Host: "work.example.com"}).StringConfig(context.Background(), "google.account"); v != "work@example.com" {
+		t.Errorf("got %q from the includeIf gitdir, want work@example.com", v)
+	}
+}
+
+func TestGitBinaryDir(t *testing.T) {
+	g, _ := FindGitBinary()
+	if g.Path == "" {
+		t.Skip("requires git to create repositories")
+	}
+	home, restore := setGitConfigEnv(t, "[includeIf \"gitdir:~/work/\"]\n\tpath = work.gitconfig\n")
+	defer restore()
+	if err := ioutil.WriteFile(filepath.Join(home, "work.gitconfig"), []byte("[google]\n\tscopes = work\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	repo := filepath.Join(home, "work", "repo")
+	bare := filepath.Join(home, "bare.git")
+	for _, args := range [][]string{
+		{"init", "-q", repo},
+		{"-C", repo, "config", "google.account", "repo@example.com"},
+		{"init", "-q", "--bare", bare},
+		{"-C", bare, "config", "google.account", "bare@example.com"},
+	} {
+		if out, err := exec.Command(g.Path, args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %q: %v\n%s", args, err, out)
+		}
+	}
+	subdir := filepath.Join(repo, "sub")
+	if err := os.Mkdir(subdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		dir     string
+		account string
+		scopes  string
+	}{
+		{subdir, "repo@example.com", "work"},
+		{bare, "bare@example.com", ""},
+		{home, "", ""},
+	} {
+		for _, gitBinary := range []GitBinary{{Path: g.Path, Dir: tc.dir}, {Dir: tc.dir}} {
+			if v, err := gitBinary.StringConfig(ctx, "google.account"); err != nil || v != tc.account {
+				t.Errorf("%+v: StringConfig(google.account) = %q, %v, want %q", gitBinary, v, err, tc.account)
+			}
+			s, err := gitBinary.Snapshot(ctx)
+			if err != nil {
+				t.Fatalf("%+v: Snapshot: %v", gitBinary, err)
+			}
+			if v, err := s.StringConfig(ctx, "google.scopes"); err != nil || v != tc.scopes {
+				t.Errorf("%+v: google.scopes in the snapshot = %q, %v, want %q", gitBinary, v, err, tc.scopes)
+			}
+		}
+	}
+
+	for _, gitBinary := range []GitBinary{{Path: g.Path}, {}} {
+		gitBinary.Dir = filepath.Join(home, "nonexistent")
+		if _, err := gitBinary.Snapshot(ctx); err == nil {
+			t.Errorf("%+v: Snapshot succeeded, want an error", gitBinary)
+		}
+	}
+}
+
+func withoutOrigin(entries []gitConfigEntry) []gitConfigEntry {
+	ret := make([]gitConfigEntry, len(entries))
+	for i, e := range entries {
+		e.origin = ""
+		ret[i] = e
+	}
+	return ret
+}
+
+func TestWildmatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		icase   bool
+		want    bool
+	}{
+		{"**/repo/**", "/home/user/repo/.git", false, true},
+		{"/home/*/repo/**", "/home/user/repo/.git", false, true},
+		{"/home/*/**", "/home/user/a/b/.git", false, true},
+		{"/home/*/.git", "/home/user/a/.git", false, false},
+		{"/home/[a-u]ser/**", "/home/user/.git", false, true},
+		{"/home/[!u]ser/**", "/home/user/.git", false, false},
+		{"/Home/**", "/home/user/.git", false, false},
+		{"/Home/**", "/home/user/.git", true, true},
+		{"release/**", "release/1.0", false, true},
+	} {
+		if got := wildmatch(tc.pattern, tc.name, tc.icase); got != tc.want {
+			t.Errorf("wildmatch(%q, %q, %t) = %t, want %t", tc.pattern, tc.name, tc.icase, got, tc.want)
+		}
+	}
+}
+
+func TestParseGitConfigFileErrors(t *testing.T) {
+	for _, data := range []string{
+		"account = outside a section\n",
+		"[google\n",
+		"[google \"unterminated]\n",
+		"[google]\n\taccount = \"unterminated\n",
+		"[google]\n\taccount = bad \\escape\n",
+		"[google]\n\t!account = x\n",
+	} {
+		if err := parseGitConfigFile(data, func(gitConfigEntry) error { return nil }); err == nil {
+			t.Errorf("parseGitConfigFile(%q) succeeded, want an error", data)
+		}
+	}
+}
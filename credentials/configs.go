@@ -19,13 +19,19 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/xerrors"
 )
 
 // CredentialConfig is the configuration for credentials.
 type CredentialConfig struct {
+	// The URL that the config is made for. This is passed to `exec:COMMAND`
+	// accounts. This can be nil.
+	URL *url.URL
+
 	// An account to be used. This can take one of the following values. If
 	// empty, it defaults to `gcloud`.
 	//
@@ -46,8 +52,9 @@ type CredentialConfig struct {
 	// *   Service account emails
 	//     (`SERVICE_ACCOUNT@YOUR_PROJECT.iam.gserviceaccount.com`)
 	//
-	//     Start from the application default credentials, use IAM Service
-	//     Account Credentials API to obtain the specified service account
+	//     Start from the application default credentials (or the
+	//     credentials in `ImpersonationSource`), use IAM Service Account
+	//     Credentials API to obtain the specified service account
 	//     credentials. The account used for the application default service
 	//     account must have `iam.serviceAccounts.getAccessToken` for the
 	//     account specified here.
@@ -55,21 +62,144 @@ type CredentialConfig struct {
 	//     In a rare situation where you need a multi-hop delegation, you can
 	//     specify a list of delegated service account emails in
 	//     `ServiceAccountDelegateEmails`.
+	//
+	// *   `external-account`
+	//
+	//     Use Workload Identity Federation. A subject token obtained as
+	//     configured in `ExternalAccount` is exchanged to an access token at
+	//     the Security Token Service.
+	//
+	// *   `metadata`, `metadata:SERVICE_ACCOUNT`
+	//
+	//     Get an access token from the GCE metadata server directly. The
+	//     service account attached to the instance can be chosen by its email
+	//     or alias. If omitted, it defaults to `default`. The metadata server
+	//     address can be overridden with `GCE_METADATA_HOST`.
+	//
+	// *   `keyfile:PATH`
+	//
+	//     Use the service account JSON key (or the authorized user JSON) at
+	//     PATH. Unlike `application-default`, this doesn't depend on
+	//     `GOOGLE_APPLICATION_CREDENTIALS`, so that each URL can use a
+	//     different key.
+	//
+	// *   `exec:COMMAND`
+	//
+	//     Run COMMAND and use the token it prints to stdout. See the README
+	//     for the substitutions, the environment variables and the output
+	//     format.
+	//
+	// The kind can be explicitly specified with a prefix: `user:EMAIL` for
+	// gcloud accounts, `sa:EMAIL` for service accounts, and `adc` for
+	// `application-default`. Without a prefix, emails ending with
+	// `.gserviceaccount.com` are service accounts, and the other emails are
+	// gcloud accounts. The other values are rejected.
+	//
+	// This can also be a comma separated list of the values above. The
+	// accounts are tried in order, and the first one that yields a token is
+	// used. `exec:COMMAND` takes the rest of the list.
 	Account string
 
+	// The profile that the configs are taken from. See the README.
+	Profile string
+
+	// Accounts parsed from `Account`. If empty, `Account` is parsed when a
+	// TokenSource is created.
+	Accounts []Account
+
 	// OAuth2 scopes. If empty, it defaults to
-	// `https://www.googleapis.com/auth/cloud-platform`.
+	// `https://www.googleapis.com/auth/gerritcodereview` and
+	// `https://www.googleapis.com/auth/userinfo.email` for
+	// `*.googlesource.com`,
+	// `https://www.googleapis.com/auth/source.read_write` and
+	// `https://www.googleapis.com/auth/userinfo.email` for
+	// `source.developers.google.com`, and
+	// `https://www.googleapis.com/auth/cloud-platform` for the other hosts.
 	//
 	// This config is usually not effective unless you use service account
-	// emails for `Account`.
+	// emails, `metadata` or `external-account` for `Account`.
 	Scopes []string
 
 	// List of service account email addresses for multi-hop authentication.
 	// See the description of `Account`.
 	ServiceAccountDelegateEmails []string
 
+	// The credentials that impersonate service account emails in `Account`.
+	// This can be `application-default`, `gcloud` or a Google Account email
+	// registered in gcloud. If empty, it defaults to `application-default`.
+	ImpersonationSource string
+
 	// Path to gcloud executable.
 	GcloudPath string
+
+	// The gcloud named configuration to use, passed as `--configuration`.
+	// If empty, gcloud uses the active configuration.
+	GcloudConfiguration string
+
+	// The gcloud config directory to use, passed as `CLOUDSDK_CONFIG`. If
+	// empty, gcloud uses its default directory.
+	GcloudConfigDir string
+
+	// If true, the credentials of `gcloud` and Google Account emails are
+	// read from gcloud's credential store directly, and refreshed without
+	// running gcloud. If the store cannot be read, gcloud is used.
+	UseGcloudCredentialStore bool
+
+	// Timeout for `exec:COMMAND` accounts. If zero, it defaults to one
+	// minute.
+	ExecTimeout time.Duration
+
+	// Timeout for obtaining a token in MakeToken, including running gcloud
+	// and calling the APIs. If zero, there's no timeout.
+	TokenTimeout time.Duration
+
+	// Minimum remaining lifetime of the returned tokens. A cached token
+	// that expires sooner is not used, and a new token is forced. For the
+	// tokens minted by IAM Service Account Credentials API, a longer
+	// lifetime is requested if this is longer than one hour. If zero, a
+	// cached token is used until shortly before it expires.
+	MinTokenLifetime time.Duration
+
+	// Lifetime of the tokens minted by IAM Service Account Credentials API,
+	// up to 12 hours. Lifetimes longer than one hour require the
+	// constraints/iam.allowServiceAccountCredentialLifetimeExtension
+	// organization policy. If zero, the tokens last one hour.
+	TokenLifetime time.Duration
+
+	// If true, `keyfile:PATH` service accounts sign JWTs by themselves and
+	// use them as access tokens instead of exchanging them at the OAuth2
+	// token endpoint. This saves a network round trip, but not all servers
+	// accept such tokens.
+	UseSelfSignedJWT bool
+
+	// The type of the token. This can take one of the following values. If
+	// empty, it defaults to `access_token`.
+	//
+	// *   `access_token`
+	//
+	//     An OAuth2 access token.
+	//
+	// *   `id_token`
+	//
+	//     An OpenID Connect ID token for `Audience`. This is needed for the
+	//     hosts behind Identity-Aware Proxy. ID tokens are supported for
+	//     `gcloud`, Google Account emails, `application-default` with a
+	//     service account key or on GCE, `metadata`, service account emails
+	//     and `external-account` with `ServiceAccount`.
+	TokenType string
+
+	// The audience of ID tokens. For Identity-Aware Proxy, this is the OAuth
+	// client ID of the proxy. gcloud supports this only for service
+	// accounts, so it's not passed to gcloud for Google Accounts.
+	Audience string
+
+	// Workload Identity Federation configs used for `external-account`.
+	ExternalAccount ExternalAccountConfig
+
+	// Directory to cache tokens in. Tokens are shared through this directory
+	// among processes and reused until shortly before they expire. If empty,
+	// tokens are not cached.
+	TokenCacheDir string
 }
 
 // GitConfigAccessor is an interface for reading git-config.
@@ -81,133 +211,288 @@ type GitConfigAccessor interface {
 	// StringConfig returns a gitconfig config value as a string.
 	StringConfig(ctx context.Context, key string) (string, error)
 	// StringListConfig returns a gitconfig config value as a string slice.
-	// The value is split by comma.
+	// All the values of a multi-valued key are collected from the least
+	// specific one, and each value is split by comma. An empty value resets
+	// the list collected so far.
 	StringListConfig(ctx context.Context, key string) ([]string, error)
 }
 
+// URLScopedConfig is a config that can be resolved for an URL, like
+// `git config --get-urlmatch`. GitBinary and GitConfigSnapshot implement this.
+type URLScopedConfig interface {
+	GitConfigAccessor
+	// WithURL returns an accessor that resolves the configs for the URL. If
+	// the URL is nil, it returns the configs not specific to URLs.
+	WithURL(u *url.URL) GitConfigAccessor
+}
+
+// snapshotter is a URLScopedConfig that is faster to read at once.
+type snapshotter interface {
+	snapshotConfig(ctx context.Context) (URLScopedConfig, error)
+}
+
+var (
+	_ URLScopedConfig = GitBinary{}
+	_ URLScopedConfig = &GitConfigSnapshot{}
+	_ URLScopedConfig = envConfig{}
+	_ snapshotter     = GitBinary{}
+	_ snapshotter     = envConfig{}
+)
+
 // GitBinary is a path to Git binary.
 type GitBinary struct {
-	// Path is a path to the Git binary.
+	// Path is a path to the Git binary. If empty, git-config files are read
+	// without git.
 	Path string
 	// Configs are the additional Git configs specified via "-c".
 	Configs []string
+	// Dir is the directory to run git in, such as a working tree or a bare
+	// repository. The config of the repository containing Dir is read, and
+	// `includeIf "gitdir:..."` and `includeIf "onbranch:..."` are evaluated
+	// for the repository. If empty, the current directory is used.
+	Dir string
 }
 
-// FindGitBinary finds a git binary from the PATH.
+// FindGitBinary finds a git binary from the PATH. If git is not found, it
+// returns a GitBinary without Path, which reads git-config files without git.
+// The error is always nil.
 func FindGitBinary() (GitBinary, error) {
 	p, err := exec.LookPath("git")
 	if err != nil {
-		return GitBinary{}, xerrors.Errorf("credentials: cannot find the git binary: %v", err)
+		return GitBinary{}, nil
 	}
 	return GitBinary{Path: p}, nil
 }
 
 // ListURLs returns a list of URLs specified for "google" section.
 func (g GitBinary) ListURLs(ctx context.Context) ([]*url.URL, error) {
-	args := append(constructConfigArgs(g), "config", "--name-only", "--list", "--null")
-	cmd := exec.CommandContext(ctx, g.Path, args...)
-	cmd.Stderr = os.Stderr
-	bs, err := cmd.Output()
+	s, err := g.Snapshot(ctx)
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get gitconfig: %v", err)
+		return nil, err
 	}
+	return s.ListURLs(ctx)
+}
 
-	m := map[string]bool{}
-	for _, s := range strings.Split(string(bs), "\000") {
-		if !strings.HasPrefix(s, "google.") {
-			continue
-		}
-		s = strings.TrimPrefix(s, "google.")
-		i := strings.LastIndexByte(s, '.')
-		if i > 0 {
-			s = s[:i]
-		}
-		if !strings.Contains(s, "://") {
-			continue
-		}
-		u, err := url.Parse(s)
-		if err != nil {
-			return nil, xerrors.Errorf("credentials: cannot parse the URL %s: %v", s, err)
-		}
-		m[u.String()] = true
-	}
-	urls := []*url.URL{}
-	for rawURL, _ := range m {
-		// The URL should be able to be re-parsed.
-		u, err := url.Parse(rawURL)
-		if err != nil {
-			panic(err)
-		}
-		urls = append(urls, u)
+// CredentialConfigFromGitConfig creates a CredentialConfig from git-config
+// and the environment variables that override it. See WithEnvOverrides.
+// git-config is read once with Snapshot.
+func (g GitBinary) CredentialConfigFromGitConfig(ctx context.Context, u *url.URL) (*CredentialConfig, error) {
+	return CredentialConfigFromConfig(ctx, WithEnvOverrides(g), u)
+}
+
+// CredentialConfigFromConfig creates a CredentialConfig for the URL from any
+// URLScopedConfig. The config keys are the same as git-config.
+func CredentialConfigFromConfig(ctx context.Context, g URLScopedConfig, u *url.URL) (*CredentialConfig, error) {
+	g, err := snapshotConfig(ctx, g)
+	if err != nil {
+		return nil, err
 	}
-	return urls, nil
+	return credentialConfigFromAccessor(ctx, g.WithURL(u), u)
 }
 
-// ConfigFromGitConfig creates a CredentialConfig from git-config.
-func (g GitBinary) CredentialConfigFromGitConfig(ctx context.Context, u *url.URL) (*CredentialConfig, error) {
-	scoped := g.WithURL(u)
+// snapshotConfig reads the config at once if it's faster.
+func snapshotConfig(ctx context.Context, g URLScopedConfig) (URLScopedConfig, error) {
+	if s, ok := g.(snapshotter); ok {
+		return s.snapshotConfig(ctx)
+	}
+	return g, nil
+}
 
-	c := &CredentialConfig{}
+// credentialConfigFromAccessor creates a CredentialConfig for the URL from
+// the accessor bound to it.
+func credentialConfigFromAccessor(ctx context.Context, scoped GitConfigAccessor, u *url.URL) (*CredentialConfig, error) {
+	c := &CredentialConfig{URL: u}
 
 	var err error
+	c.Profile, err = scoped.StringConfig(ctx, "google.profile")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get google.profile config: %w", err)
+	}
 	c.Account, err = scoped.StringConfig(ctx, "google.account")
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get google.account config: %v", err)
+		return nil, xerrors.Errorf("credentials: cannot get google.account config: %w", err)
+	}
+	c.Accounts, err = ParseAccounts(c.Account)
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: invalid google.account: %w", err)
 	}
 
 	c.Scopes, err = scoped.StringListConfig(ctx, "google.scopes")
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get a list of OAuth2 scopes: %v", err)
+		return nil, xerrors.Errorf("credentials: cannot get a list of OAuth2 scopes: %w", err)
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = defaultScopes(u)
 	}
 
 	c.ServiceAccountDelegateEmails, err = scoped.StringListConfig(ctx, "google.serviceAccountDelegateEmails")
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get a list of service account delegates: %v", err)
+		return nil, xerrors.Errorf("credentials: cannot get a list of service account delegates: %w", err)
+	}
+
+	c.ImpersonationSource, err = scoped.StringConfig(ctx, "google.impersonationSource")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get google.impersonationSource config: %w", err)
 	}
 
 	c.GcloudPath, err = scoped.PathConfig(ctx, "google.gcloudPath")
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get the gcloud path: %v", err)
+		return nil, xerrors.Errorf("credentials: cannot get the gcloud path: %w", err)
+	}
+
+	c.GcloudConfiguration, err = scoped.StringConfig(ctx, "google.gcloudConfiguration")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get google.gcloudConfiguration config: %w", err)
+	}
+
+	c.GcloudConfigDir, err = scoped.PathConfig(ctx, "google.gcloudConfigDir")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get the gcloud config directory: %w", err)
+	}
+
+	c.UseGcloudCredentialStore, err = scoped.BoolConfig(ctx, "google.useGcloudCredentialStore")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get google.useGcloudCredentialStore config: %w", err)
+	}
+
+	c.ExecTimeout, err = durationConfig(ctx, scoped, "google.execTimeout")
+	if err != nil {
+		return nil, err
+	}
+
+	c.TokenTimeout, err = durationConfig(ctx, scoped, "google.tokenTimeout")
+	if err != nil {
+		return nil, err
+	}
+
+	c.MinTokenLifetime, err = durationConfig(ctx, scoped, "google.minTokenLifetime")
+	if err != nil {
+		return nil, err
+	}
+
+	c.TokenLifetime, err = durationConfig(ctx, scoped, "google.tokenLifetime")
+	if err != nil {
+		return nil, err
+	}
+
+	c.UseSelfSignedJWT, err = scoped.BoolConfig(ctx, "google.useSelfSignedJWT")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get google.useSelfSignedJWT config: %w", err)
+	}
+
+	c.TokenType, err = scoped.StringConfig(ctx, "google.tokenType")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get google.tokenType config: %w", err)
+	}
+
+	c.Audience, err = scoped.StringConfig(ctx, "google.audience")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get google.audience config: %w", err)
+	}
+
+	for _, a := range c.Accounts {
+		if a.Kind == AccountKindExternalAccount {
+			if err := externalAccountConfigFromGitConfig(ctx, scoped, &c.ExternalAccount); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	disableTokenCache, err := scoped.BoolConfig(ctx, "google.disableTokenCache")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get google.disableTokenCache config: %w", err)
+	}
+	if !disableTokenCache {
+		c.TokenCacheDir, err = scoped.PathConfig(ctx, "google.tokenCacheDir")
+		if err != nil {
+			return nil, xerrors.Errorf("credentials: cannot get the token cache directory: %w", err)
+		}
+		if c.TokenCacheDir == "" {
+			c.TokenCacheDir, err = DefaultTokenCacheDir()
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return c, nil
 }
 
 // WithURL binds an URL for git-config. This makes it specify --get-urlmatch.
+// If `google.profile` is set for the URL, the `google.*` configs are resolved
+// with the profile in Go as Snapshot does.
 func (g GitBinary) WithURL(u *url.URL) GitConfigAccessor {
-	return gitConfigAccessor{g, u}
+	if g.Path == "" {
+		return fileConfigAccessor{gitBinary: g, u: u}
+	}
+	return gitConfigAccessor{gitBinary: g, u: u}
 }
 
 func (g GitBinary) BoolConfig(ctx context.Context, key string) (bool, error) {
-	return gitConfigAccessor{g, nil}.BoolConfig(ctx, key)
+	return g.WithURL(nil).BoolConfig(ctx, key)
 }
 
 func (g GitBinary) PathConfig(ctx context.Context, key string) (string, error) {
-	return gitConfigAccessor{g, nil}.PathConfig(ctx, key)
+	return g.WithURL(nil).PathConfig(ctx, key)
 }
 
 func (g GitBinary) StringConfig(ctx context.Context, key string) (string, error) {
-	return gitConfigAccessor{g, nil}.StringConfig(ctx, key)
+	return g.WithURL(nil).StringConfig(ctx, key)
 }
 
 func (g GitBinary) StringListConfig(ctx context.Context, key string) ([]string, error) {
-	return gitConfigAccessor{g, nil}.StringListConfig(ctx, key)
+	return g.WithURL(nil).StringListConfig(ctx, key)
 }
 
 type gitConfigAccessor struct {
 	gitBinary GitBinary
 	u         *url.URL
+	// profileOverride is the profile to use instead of `google.profile`,
+	// or nil to use `google.profile`.
+	profileOverride *string
+}
+
+func (g gitConfigAccessor) withProfile(profile string) GitConfigAccessor {
+	g.profileOverride = &profile
+	return g
+}
+
+// profileAccessor returns the accessor that resolves the key with the profile
+// if the key is a `google.*` key and a profile is set. Otherwise it returns
+// nil.
+func (g gitConfigAccessor) profileAccessor(ctx context.Context, key string) (GitConfigAccessor, error) {
+	section, subsection, name, ok := splitGitConfigKey(key)
+	if !ok || section != "google" || subsection != "" || name == "profile" {
+		return nil, nil
+	}
+	var profile string
+	if g.profileOverride != nil {
+		profile = strings.TrimSpace(*g.profileOverride)
+	} else {
+		var err error
+		if profile, err = g.get(ctx, "--no-type", "google.profile"); err != nil {
+			return nil, err
+		}
+	}
+	if profile == "" {
+		return nil, nil
+	}
+	s, err := g.regexpSnapshot(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotAccessor{snapshot: s, u: g.u, profileOverride: &profile}, nil
 }
 
 func (g gitConfigAccessor) get(ctx context.Context, ty, key string) (string, error) {
-	args := append(constructConfigArgs(g.gitBinary), "config", ty)
+	args := []string{ty}
 	if g.u != nil {
 		args = append(args, "--get-urlmatch", key, g.u.String())
 	} else {
 		args = append(args, key)
 	}
-	cmd := exec.CommandContext(ctx, g.gitBinary.Path, args...)
-	cmd.Stderr = os.Stderr
+	cmd := g.gitBinary.configCommand(ctx, args...)
 	bs, err := cmd.Output()
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
@@ -216,40 +501,179 @@ func (g gitConfigAccessor) get(ctx context.Context, ty, key string) (string, err
 				return "", nil
 			}
 		}
-		return "", xerrors.Errorf("credentials: cannot get gitconfig: %v", err)
+		return "", xerrors.Errorf("credentials: cannot get gitconfig: %w", err)
 	}
 	return strings.TrimSpace(string(bs)), nil
 }
 
 func (g gitConfigAccessor) BoolConfig(ctx context.Context, key string) (bool, error) {
+	a, err := g.profileAccessor(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if a != nil {
+		return a.BoolConfig(ctx, key)
+	}
 	v, err := g.get(ctx, "--bool", key)
 	if err != nil {
 		return false, err
 	}
-	return v != "false", nil
+	return v == "true", nil
 }
 
 func (g gitConfigAccessor) PathConfig(ctx context.Context, key string) (string, error) {
+	a, err := g.profileAccessor(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if a != nil {
+		return a.PathConfig(ctx, key)
+	}
 	return g.get(ctx, "--path", key)
 }
 
 func (g gitConfigAccessor) StringConfig(ctx context.Context, key string) (string, error) {
+	a, err := g.profileAccessor(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if a != nil {
+		return a.StringConfig(ctx, key)
+	}
 	return g.get(ctx, "--no-type", key)
 }
 
 func (g gitConfigAccessor) StringListConfig(ctx context.Context, key string) ([]string, error) {
-	v, err := g.get(ctx, "--no-type", key)
+	a, err := g.profileAccessor(ctx, key)
 	if err != nil {
 		return nil, err
 	}
+	if a != nil {
+		return a.StringListConfig(ctx, key)
+	}
+	if g.u != nil {
+		return g.urlStringListConfig(ctx, key)
+	}
+	cmd := g.gitBinary.configCommand(ctx, "--no-type", "--null", "--get-all", key)
+	bs, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+			// The key doesn't exist in the config.
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("credentials: cannot get gitconfig: %w", err)
+	}
+	values := strings.Split(string(bs), "\000")
+	// The output ends with NUL.
+	return mergeStringList(values[:len(values)-1]), nil
+}
+
+// urlStringListConfig collects the values of a multi-valued key for the URL.
+// `git config --get-urlmatch` returns only the most specific value, so the
+// values are read with regexpSnapshot, and the URL match is done in Go.
+func (g gitConfigAccessor) urlStringListConfig(ctx context.Context, key string) ([]string, error) {
+	s, err := g.regexpSnapshot(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.WithURL(g.u).StringListConfig(ctx, key)
+}
+
+// regexpSnapshot reads the entries of the key in any URL subsection with
+// `git config --get-regexp`. For a google.* key, google.profile and all the
+// profile entries are read too, so that the profile is resolved as Snapshot
+// does.
+func (g gitConfigAccessor) regexpSnapshot(ctx context.Context, key string) (*GitConfigSnapshot, error) {
+	section, subsection, name, ok := splitGitConfigKey(key)
+	if !ok || subsection != "" {
+		return nil, xerrors.Errorf("credentials: invalid git-config key %q", key)
+	}
+	pattern := regexp.QuoteMeta(section) + `\.(.+\.)?` + regexp.QuoteMeta(name)
+	if section == "google" {
+		// All the profile entries are read to tell if a profile is
+		// defined.
+		pattern = `(` + pattern + `|google\.(.+\.)?profile|` + profileSection + `\..+\..+)`
+	}
+	cmd := g.gitBinary.configCommand(ctx, "--no-type", "--null", "--get-regexp", "^"+pattern+"$")
+	bs, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+			// The key doesn't exist in the config.
+			return &GitConfigSnapshot{}, nil
+		}
+		return nil, xerrors.Errorf("credentials: cannot get gitconfig: %w", err)
+	}
+	s := &GitConfigSnapshot{}
+	// Each entry is `KEY\nVALUE`, or `KEY` without a value, terminated by
+	// NUL.
+	for _, entry := range strings.Split(strings.TrimSuffix(string(bs), "\000"), "\000") {
+		kv := strings.SplitN(entry, "\n", 2)
+		if len(kv) == 1 {
+			err = s.add("", kv[0], "", true)
+		} else {
+			err = s.add("", kv[0], kv[1], false)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// mergeStringList merges the values of a multi-valued key. Each value is split
+// by comma, and an empty value resets the list as git does for
+// credential.helper. It returns nil for an empty list.
+func mergeStringList(values []string) []string {
+	var ss []string
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			ss = nil
+			continue
+		}
+		ss = append(ss, splitStringList(strings.TrimSpace(v))...)
+	}
+	return ss
+}
+
+// splitStringList splits a comma separated value. It returns nil for an empty
+// value.
+func splitStringList(v string) []string {
 	if v == "" {
-		return nil, nil
+		return nil
 	}
 	ss := []string{}
 	for _, s := range strings.Split(v, ",") {
 		ss = append(ss, strings.TrimSpace(s))
 	}
-	return ss, nil
+	return ss
+}
+
+// durationConfig returns a gitconfig config value as a time.Duration. The
+// value is parsed by time.ParseDuration, e.g. "30s". It returns zero if the
+// key doesn't exist.
+func durationConfig(ctx context.Context, g GitConfigAccessor, key string) (time.Duration, error) {
+	v, err := g.StringConfig(ctx, key)
+	if err != nil {
+		return 0, xerrors.Errorf("credentials: cannot get %s config: %w", key, err)
+	}
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, xerrors.Errorf("credentials: cannot parse %s config %q: %w", key, v, err)
+	}
+	return d, nil
+}
+
+// configCommand returns a `git config` command with the args. The command runs
+// in Dir with Configs.
+func (g GitBinary) configCommand(ctx context.Context, args ...string) *exec.Cmd {
+	args = append(append(constructConfigArgs(g), "config"), args...)
+	cmd := exec.CommandContext(ctx, g.Path, args...)
+	cmd.Dir = g.Dir
+	cmd.Stderr = os.Stderr
+	return cmd
 }
 
 func constructConfigArgs(g GitBinary) []string {
@@ -0,0 +1,620 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// GitConfigSnapshot is git-config read at once. It resolves the configs in Go
+// with the same rules as `git config --get-urlmatch`, so that reading many
+// configs doesn't run git for each of them.
+//
+// In addition, it resolves the profile in `google.profile`. The configs in the
+// `[googleProfile "NAME"]` section take precedence over the global `google.*`
+// configs, and the URL-specific `google.*` configs take precedence over the
+// profile. A list in the profile replaces the global one.
+type GitConfigSnapshot struct {
+	entries []gitConfigEntry
+	// linesFilled is true if the line numbers of the entries read by git
+	// are filled.
+	linesFilled bool
+}
+
+// gitConfigEntry is an entry of git-config.
+type gitConfigEntry struct {
+	// origin is where the entry is defined, such as `file:PATH` and
+	// `command line:`.
+	origin string
+	// section and name are lowercased as git does. subsection is as is.
+	section    string
+	subsection string
+	name       string
+	value      string
+	// noValue is true for a key without `=`, which is true as a boolean.
+	noValue bool
+	// line is the line number in the file, or zero if unknown.
+	line int
+}
+
+// key returns the key of the entry in the form of `git config --list`.
+func (e *gitConfigEntry) key() string {
+	if e.subsection == "" {
+		return e.section + "." + e.name
+	}
+	return e.section + "." + e.subsection + "." + e.name
+}
+
+// profileSection is the lowercased section of the profiles,
+// `[googleProfile "NAME"]`.
+const profileSection = "googleprofile"
+
+// NewGitConfigSnapshot creates an in-memory GitConfigSnapshot from configs in
+// the form of `git -c`, e.g. `google.account=EMAIL` and
+// `google.https://example.googlesource.com.account=EMAIL`. This is for the
+// programs that keep the configs elsewhere than git-config.
+func NewGitConfigSnapshot(configs ...string) (*GitConfigSnapshot, error) {
+	s := &GitConfigSnapshot{}
+	for _, c := range configs {
+		if err := s.addParameter("memory:", c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Add adds a config. Like git-config, it takes precedence over the configs
+// added earlier for the same URL.
+func (s *GitConfigSnapshot) Add(key, value string) error {
+	return s.add("memory:", key, value, false)
+}
+
+// addParameter adds a config in the form of `git -c KEY=VALUE`. A config
+// without `=` is true as a boolean.
+func (s *GitConfigSnapshot) addParameter(origin, c string) error {
+	kv := strings.SplitN(c, "=", 2)
+	if len(kv) == 1 {
+		return s.add(origin, kv[0], "", true)
+	}
+	return s.add(origin, kv[0], kv[1], false)
+}
+
+func (s *GitConfigSnapshot) add(origin, key, value string, noValue bool) error {
+	section, subsection, name, ok := splitGitConfigKey(key)
+	if !ok {
+		return xerrors.Errorf("credentials: invalid git-config key %q", key)
+	}
+	s.entries = append(s.entries, gitConfigEntry{
+		origin:     origin,
+		section:    section,
+		subsection: subsection,
+		name:       name,
+		value:      value,
+		noValue:    noValue,
+	})
+	return nil
+}
+
+// Snapshot reads all the git-config entries with one git invocation. If Path
+// is empty, the git-config files are read without git.
+func (g GitBinary) Snapshot(ctx context.Context) (*GitConfigSnapshot, error) {
+	if g.Path == "" {
+		return readGitConfigFiles(g.Dir, g.Configs)
+	}
+	cmd := g.configCommand(ctx, "--list", "--null", "--show-origin")
+	bs, err := cmd.Output()
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot get gitconfig: %w", err)
+	}
+	return parseGitConfigList(string(bs))
+}
+
+func (g GitBinary) snapshotConfig(ctx context.Context) (URLScopedConfig, error) {
+	return g.Snapshot(ctx)
+}
+
+// parseGitConfigList parses the output of `git config --list --null
+// --show-origin`. Each entry is the origin and `KEY\nVALUE`, or `KEY` if
+// the entry has no value, terminated by NUL.
+func parseGitConfigList(s string) (*GitConfigSnapshot, error) {
+	fields := strings.Split(s, "\000")
+	// The output ends with NUL.
+	fields = fields[:len(fields)-1]
+	if len(fields)%2 != 0 {
+		return nil, xerrors.New("credentials: cannot parse the output of git config --list")
+	}
+	snapshot := &GitConfigSnapshot{}
+	for i := 0; i < len(fields); i += 2 {
+		e := gitConfigEntry{origin: fields[i]}
+		key := fields[i+1]
+		if j := strings.IndexByte(key, '\n'); j >= 0 {
+			key, e.value = key[:j], key[j+1:]
+		} else {
+			e.noValue = true
+		}
+		var ok bool
+		e.section, e.subsection, e.name, ok = splitGitConfigKey(key)
+		if !ok {
+			return nil, xerrors.Errorf("credentials: invalid git-config key %q", key)
+		}
+		snapshot.entries = append(snapshot.entries, e)
+	}
+	return snapshot, nil
+}
+
+// fillLines fills the line numbers of the entries read from files by git,
+// which doesn't tell them. Each file is parsed in Go, and its entries are
+// numbered in order.
+func (s *GitConfigSnapshot) fillLines() {
+	if s.linesFilled {
+		return
+	}
+	s.linesFilled = true
+	byOrigin := map[string][]*gitConfigEntry{}
+	for i := range s.entries {
+		e := &s.entries[i]
+		if e.line == 0 && strings.HasPrefix(e.origin, "file:") {
+			byOrigin[e.origin] = append(byOrigin[e.origin], e)
+		}
+	}
+	for origin, entries := range byOrigin {
+		bs, err := ioutil.ReadFile(strings.TrimPrefix(origin, "file:"))
+		if err != nil {
+			continue
+		}
+		var lines []int
+		if err := parseGitConfigFile(string(bs), func(e gitConfigEntry) error {
+			lines = append(lines, e.line)
+			return nil
+		}); err != nil || len(lines) != len(entries) {
+			// The file has changed since git read it.
+			continue
+		}
+		for i, e := range entries {
+			e.line = lines[i]
+		}
+	}
+}
+
+// splitGitConfigKey splits `SECTION.SUBSECTION.NAME` or `SECTION.NAME`. The
+// subsection can contain dots.
+func splitGitConfigKey(key string) (section, subsection, name string, ok bool) {
+	i := strings.IndexByte(key, '.')
+	j := strings.LastIndexByte(key, '.')
+	if i <= 0 || j == len(key)-1 {
+		return "", "", "", false
+	}
+	section, name = strings.ToLower(key[:i]), strings.ToLower(key[j+1:])
+	if i < j {
+		subsection = key[i+1 : j]
+	}
+	return section, subsection, name, true
+}
+
+// ListURLs returns a list of URLs specified for "google" section.
+func (s *GitConfigSnapshot) ListURLs(ctx context.Context) ([]*url.URL, error) {
+	seen := map[string]bool{}
+	urls := []*url.URL{}
+	for _, e := range s.entries {
+		if e.section != "google" || !strings.Contains(e.subsection, "://") {
+			continue
+		}
+		u, err := url.Parse(e.subsection)
+		if err != nil {
+			return nil, xerrors.Errorf("credentials: cannot parse the URL %s: %w", e.subsection, err)
+		}
+		if seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// CredentialConfigFromGitConfig creates a CredentialConfig from the snapshot.
+func (s *GitConfigSnapshot) CredentialConfigFromGitConfig(ctx context.Context, u *url.URL) (*CredentialConfig, error) {
+	return CredentialConfigFromConfig(ctx, s, u)
+}
+
+// URLSpecificStringConfig returns the config for the URL only if it's set in a
+// URL subsection that matches u, e.g. `google.https://example.com.tokenType`.
+// The configs without a subsection and the profiles are ignored. It returns
+// empty if there's none.
+func (s *GitConfigSnapshot) URLSpecificStringConfig(ctx context.Context, u *url.URL, key string) (string, error) {
+	none := ""
+	e, err := snapshotAccessor{snapshot: s, u: u, profileOverride: &none}.lookup(key)
+	if err != nil || e == nil || e.subsection == "" {
+		return "", err
+	}
+	return strings.TrimSpace(e.value), nil
+}
+
+// WithURL binds an URL. The configs are resolved as `git config
+// --get-urlmatch`.
+func (s *GitConfigSnapshot) WithURL(u *url.URL) GitConfigAccessor {
+	return snapshotAccessor{snapshot: s, u: u}
+}
+
+func (s *GitConfigSnapshot) BoolConfig(ctx context.Context, key string) (bool, error) {
+	return snapshotAccessor{snapshot: s}.BoolConfig(ctx, key)
+}
+
+func (s *GitConfigSnapshot) PathConfig(ctx context.Context, key string) (string, error) {
+	return snapshotAccessor{snapshot: s}.PathConfig(ctx, key)
+}
+
+func (s *GitConfigSnapshot) StringConfig(ctx context.Context, key string) (string, error) {
+	return snapshotAccessor{snapshot: s}.StringConfig(ctx, key)
+}
+
+func (s *GitConfigSnapshot) StringListConfig(ctx context.Context, key string) ([]string, error) {
+	return snapshotAccessor{snapshot: s}.StringListConfig(ctx, key)
+}
+
+type snapshotAccessor struct {
+	snapshot *GitConfigSnapshot
+	u        *url.URL
+	// profileOverride is the profile to use instead of `google.profile`,
+	// or nil to use `google.profile`.
+	profileOverride *string
+}
+
+func (a snapshotAccessor) withProfile(profile string) GitConfigAccessor {
+	a.profileOverride = &profile
+	return a
+}
+
+// lookup returns the entry that git would return for the key, or nil if
+// there's none. Without an URL, only the entries without a subsection are
+// looked at, and the last one wins. With an URL, the entries whose subsection
+// matches the URL are looked at too, and the best match wins.
+func (a snapshotAccessor) lookup(key string) (*gitConfigEntry, error) {
+	matches, err := a.lookupAll(key)
+	if err != nil || len(matches) == 0 {
+		return nil, err
+	}
+	return matches[len(matches)-1], nil
+}
+
+// lookupAll returns all the entries for the key that match the URL, from the
+// least specific match to the most specific one. The entries of the same
+// specificity are in the config order.
+//
+// A `google.*` key is looked up in the profile in `google.profile` as well.
+// If the profile has the key, the global entries are dropped so that a list
+// in the profile replaces the global one. A key with a subsection, such as `googleProfile.NAME.account`, is looked up
+// as is without the URL.
+func (a snapshotAccessor) lookupAll(key string) ([]*gitConfigEntry, error) {
+	section, subsection, name, ok := splitGitConfigKey(key)
+	if !ok {
+		return nil, xerrors.Errorf("credentials: invalid git-config key %q", key)
+	}
+	if subsection != "" {
+		var entries []*gitConfigEntry
+		for i := range a.snapshot.entries {
+			e := &a.snapshot.entries[i]
+			if e.section == section && e.subsection == subsection && e.name == name {
+				entries = append(entries, e)
+			}
+		}
+		return entries, nil
+	}
+	var target *normalizedURL
+	if a.u != nil {
+		target, ok = normalizeURL(a.u.String())
+		if !ok {
+			return nil, xerrors.Errorf("credentials: cannot match git-config with the URL %s", a.u)
+		}
+	}
+	var profile string
+	if section == "google" && name != "profile" {
+		var err error
+		if profile, err = a.profile(); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []*gitConfigEntry
+	var matches []urlMatch
+	inProfile := false
+	for i := range a.snapshot.entries {
+		e := &a.snapshot.entries[i]
+		if e.name != name {
+			continue
+		}
+		var m urlMatch
+		switch {
+		case profile != "" && e.section == profileSection && e.subsection == profile:
+			m.profile = true
+			inProfile = true
+		case e.section != section:
+			continue
+		case e.subsection != "":
+			if target == nil {
+				continue
+			}
+			if m, ok = target.match(e.subsection); !ok {
+				continue
+			}
+		}
+		entries = append(entries, e)
+		matches = append(matches, m)
+	}
+	if inProfile {
+		var es []*gitConfigEntry
+		var ms []urlMatch
+		for i, e := range entries {
+			// The global entries are the ones without a subsection.
+			if e.subsection != "" {
+				es = append(es, e)
+				ms = append(ms, matches[i])
+			}
+		}
+		entries, matches = es, ms
+	}
+	sort.Stable(entriesByMatch{entries, matches})
+	return entries, nil
+}
+
+// profile returns the profile name in `google.profile` for the URL, or the
+// overridden one. It returns an error if the profile is not defined.
+func (a snapshotAccessor) profile() (string, error) {
+	profile, source := "", "google.profile"
+	if a.profileOverride != nil {
+		profile, source = strings.TrimSpace(*a.profileOverride), envConfigName(source)
+	} else {
+		e, err := a.lookup("google.profile")
+		if err != nil || e == nil {
+			return "", err
+		}
+		profile = strings.TrimSpace(e.value)
+	}
+	if profile == "" {
+		return "", nil
+	}
+	for _, e := range a.snapshot.entries {
+		if e.section == profileSection && e.subsection == profile {
+			return profile, nil
+		}
+	}
+	return "", xerrors.Errorf("credentials: profile %q in %s is not defined. Add the configs to the [googleProfile %q] section", profile, source, profile)
+}
+
+type entriesByMatch struct {
+	entries []*gitConfigEntry
+	matches []urlMatch
+}
+
+func (s entriesByMatch) Len() int           { return len(s.entries) }
+func (s entriesByMatch) Less(i, j int) bool { return s.matches[i].less(s.matches[j]) }
+func (s entriesByMatch) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.matches[i], s.matches[j] = s.matches[j], s.matches[i]
+}
+
+func (a snapshotAccessor) BoolConfig(ctx context.Context, key string) (bool, error) {
+	e, err := a.lookup(key)
+	if err != nil || e == nil {
+		return false, err
+	}
+	if e.noValue {
+		return true, nil
+	}
+	v, err := parseGitBool(e.value)
+	if err != nil {
+		return false, xerrors.Errorf("credentials: bad boolean config value %q for %s: %w", e.value, key, err)
+	}
+	return v, nil
+}
+
+func (a snapshotAccessor) PathConfig(ctx context.Context, key string) (string, error) {
+	e, err := a.lookup(key)
+	if err != nil || e == nil {
+		return "", err
+	}
+	p, err := expandGitPath(strings.TrimSpace(e.value))
+	if err != nil {
+		return "", xerrors.Errorf("credentials: cannot expand %s config %q: %w", key, e.value, err)
+	}
+	return p, nil
+}
+
+func (a snapshotAccessor) StringConfig(ctx context.Context, key string) (string, error) {
+	e, err := a.lookup(key)
+	if err != nil || e == nil {
+		return "", err
+	}
+	return strings.TrimSpace(e.value), nil
+}
+
+func (a snapshotAccessor) StringListConfig(ctx context.Context, key string) ([]string, error) {
+	entries, err := a.lookupAll(key)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(entries))
+	for _, e := range entries {
+		values = append(values, e.value)
+	}
+	return mergeStringList(values), nil
+}
+
+// parseGitBool parses a boolean as `git config --bool` does.
+func parseGitBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off", "":
+		return false, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+// expandGitPath expands `~/` and `~USER/` as `git config --path` does.
+func expandGitPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "~") {
+		return p, nil
+	}
+	i := strings.IndexByte(p, '/')
+	if i < 0 {
+		i = len(p)
+	}
+	var home string
+	if name := p[1:i]; name == "" {
+		home = os.Getenv("HOME")
+		if home == "" {
+			var err error
+			if home, err = os.UserHomeDir(); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		home = u.HomeDir
+	}
+	return home + p[i:], nil
+}
+
+// urlMatch is how specific a match of git-config URL subsection is.
+type urlMatch struct {
+	hostLen     int
+	pathLen     int
+	userMatched bool
+	// profile is true for the entries in the googleProfile section, which
+	// are more specific than the global entries but less specific than any
+	// URL match.
+	profile bool
+}
+
+// less reports whether m is less specific than o. The host is compared
+// first, then the path, then the user name, then the profile.
+func (m urlMatch) less(o urlMatch) bool {
+	if m.hostLen != o.hostLen {
+		return m.hostLen < o.hostLen
+	}
+	if m.pathLen != o.pathLen {
+		return m.pathLen < o.pathLen
+	}
+	if m.userMatched != o.userMatched {
+		return !m.userMatched
+	}
+	return !m.profile && o.profile
+}
+
+// normalizedURL is an URL normalized for git's urlmatch.
+type normalizedURL struct {
+	scheme string
+	user   string
+	host   string
+	port   string
+	path   string
+}
+
+func normalizeURL(s string) (*normalizedURL, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Opaque != "" {
+		return nil, false
+	}
+	n := &normalizedURL{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Hostname()),
+		port:   u.Port(),
+		path:   u.EscapedPath(),
+	}
+	if u.User != nil {
+		n.user = u.User.Username()
+	}
+	if (n.scheme == "http" && n.port == "80") || (n.scheme == "https" && n.port == "443") {
+		n.port = ""
+	}
+	if n.path == "" {
+		n.path = "/"
+	}
+	return n, true
+}
+
+// match matches the URL with a git-config URL subsection.
+func (n *normalizedURL) match(subsection string) (urlMatch, bool) {
+	p, ok := normalizeURL(subsection)
+	if !ok || p.scheme != n.scheme || p.port != n.port {
+		return urlMatch{}, false
+	}
+	m := urlMatch{}
+	if p.user != "" {
+		if p.user != n.user {
+			return urlMatch{}, false
+		}
+		m.userMatched = true
+	}
+	if !matchHost(p.host, n.host) {
+		return urlMatch{}, false
+	}
+	m.hostLen = len(p.host)
+	if m.pathLen = matchPathPrefix(p.path, n.path); m.pathLen == 0 {
+		return urlMatch{}, false
+	}
+	return m, true
+}
+
+// matchHost matches a host with a pattern, where `*` matches within a label.
+func matchHost(pattern, host string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == host
+	}
+	pl, hl := strings.Split(pattern, "."), strings.Split(host, ".")
+	if len(pl) != len(hl) {
+		return false
+	}
+	for i := range pl {
+		if ok, err := path.Match(pl[i], hl[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPathPrefix returns the length of the match of the path prefix, or 0
+// if it doesn't match. The prefix must end at a path component boundary.
+func matchPathPrefix(prefix, p string) int {
+	if prefix == "/" {
+		return 1
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(p, prefix) {
+		return 0
+	}
+	if len(p) == len(prefix) || p[len(prefix)] == '/' {
+		return len(prefix) + 1
+	}
+	return 0
+}
@@ -0,0 +1,479 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const sampleGitConfig = `[google]
+	account = global@example.com
+	scopes = a, b
+	useGcloudCredentialStore
+	tokenCacheDir = ~/cache
+[google "https://example.googlesource.com"]
+	account = host@example.com
+	useGcloudCredentialStore = no
+[google "https://example.googlesource.com/a"]
+	account = path-a@example.com
+	tokenCacheDir = ~/cache-a
+[google "https://example.googlesource.com/a/b/"]
+	account = path-a-b@example.com
+[google "https://*.googlesource.com"]
+	account = wildcard@example.com
+	scopes = wildcard
+[google "https://*.googlesource.com/a/b/c"]
+	account = wildcard-path@example.com
+[google "https://user@example.googlesource.com"]
+	account = user@example.com
+[google "https://example.googlesource.com:8443"]
+	account = port@example.com
+[google "http://example.googlesource.com"]
+	account = http@example.com
+	useGcloudCredentialStore = 1
+[Google "https://Example.com"]
+	Account = mixed-case@example.com
+[google "https://example.googlesource.com"]
+	scopes = later
+`
+
+// setGitConfigEnv makes git read only the global config written to a temporary
+// HOME, and unsets the environment variables that add or override configs. It
+// returns a function that restores the environment.
+func setGitConfigEnv(t *testing.T, gitconfig string) (home string, restore func()) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, ".gitconfig"), []byte(gitconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// An empty value unsets the variable.
+	env := map[string]string{
+		"HOME":                  home,
+		"XDG_CONFIG_HOME":       filepath.Join(home, ".config"),
+		"GIT_CONFIG_NOSYSTEM":   "1",
+		"GIT_CONFIG_GLOBAL":     "",
+		"GIT_CONFIG_COUNT":      "",
+		"GIT_CONFIG_PARAMETERS": "",
+		"GIT_DIR":               "",
+	}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envConfigPrefix) {
+			env[kv[:strings.IndexByte(kv, '=')]] = ""
+		}
+	}
+	saved := map[string]*string{}
+	for k, v := range env {
+		if old, ok := os.LookupEnv(k); ok {
+			saved[k] = &old
+		} else {
+			saved[k] = nil
+		}
+		if v == "" {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, v)
+		}
+	}
+	return home, func() {
+		for k, v := range saved {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+		os.RemoveAll(home)
+	}
+}
+
+func TestGitConfigSnapshot(t *testing.T) {
+	g, _ := FindGitBinary()
+	if g.Path == "" {
+		t.Skip("requires git")
+	}
+	_, restore := setGitConfigEnv(t, sampleGitConfig)
+	defer restore()
+	g.Configs = []string{
+		"google.https://cli.googlesource.com.account=cli@example.com",
+		"google.https://example.googlesource.com/a.scopes=cli",
+	}
+
+	ctx := context.Background()
+	snapshot, err := g.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	urls := []string{
+		"https://example.googlesource.com",
+		"https://example.googlesource.com/",
+		"https://example.googlesource.com/a",
+		"https://example.googlesource.com/ab",
+		"https://example.googlesource.com/a/b",
+		"https://example.googlesource.com/a/b/c/d",
+		"https://other.googlesource.com/a/b/c",
+		"https://user@example.googlesource.com/a",
+		"https://other@example.googlesource.com/a",
+		"https://example.googlesource.com:443/a",
+		"https://example.googlesource.com:8443/a",
+		"http://example.googlesource.com/a",
+		"https://EXAMPLE.com/repo",
+		"https://cli.googlesource.com/repo",
+		"https://googlesource.com",
+		"https://example.com.evil.com",
+	}
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareGitConfigAccessors(t, rawURL, g.WithURL(u), snapshot.WithURL(u))
+	}
+	compareGitConfigAccessors(t, "no URL", g, snapshot)
+}
+
+func compareGitConfigAccessors(t *testing.T, name string, want, got GitConfigAccessor) {
+	t.Helper()
+	ctx := context.Background()
+	for _, key := range []string{"google.account", "google.scopes", "google.missing"} {
+		w, err := want.StringConfig(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: git StringConfig(%s): %v", name, key, err)
+		}
+		g, err := got.StringConfig(ctx, key)
+		if err != nil {
+			t.Errorf("%s: StringConfig(%s): %v", name, key, err)
+		} else if g != w {
+			t.Errorf("%s: StringConfig(%s) = %q, git returns %q", name, key, g, w)
+		}
+
+		wl, err := want.StringListConfig(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: git StringListConfig(%s): %v", name, key, err)
+		}
+		gl, err := got.StringListConfig(ctx, key)
+		if err != nil || !reflect.DeepEqual(gl, wl) {
+			t.Errorf("%s: StringListConfig(%s) = %q, %v, git returns %q", name, key, gl, err, wl)
+		}
+		// git --get-urlmatch returns only the most specific value, which
+		// must come last in the list.
+		if last := splitStringList(w); len(last) > 0 && (len(gl) < len(last) || !reflect.DeepEqual(gl[len(gl)-len(last):], last)) {
+			t.Errorf("%s: StringListConfig(%s) = %q, want it to end with %q from git", name, key, gl, last)
+		}
+	}
+	for _, key := range []string{"google.useGcloudCredentialStore", "google.missing"} {
+		w, err := want.BoolConfig(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: git BoolConfig(%s): %v", name, key, err)
+		}
+		if g, err := got.BoolConfig(ctx, key); err != nil || g != w {
+			t.Errorf("%s: BoolConfig(%s) = %t, %v, git returns %t", name, key, g, err, w)
+		}
+	}
+	for _, key := range []string{"google.tokenCacheDir", "google.missing"} {
+		w, err := want.PathConfig(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: git PathConfig(%s): %v", name, key, err)
+		}
+		if g, err := got.PathConfig(ctx, key); err != nil || g != w {
+			t.Errorf("%s: PathConfig(%s) = %q, %v, git returns %q", name, key, g, err, w)
+		}
+	}
+}
+
+func TestGitConfigSnapshotCredentialConfig(t *testing.T) {
+	g, _ := FindGitBinary()
+	if g.Path == "" {
+		t.Skip("requires git")
+	}
+	home, restore := setGitConfigEnv(t, sampleGitConfig)
+	defer restore()
+
+	snapshot, err := g.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	u := &url.URL{Scheme: "https", Host: "example.googlesource.com", Path: "/a/b"}
+	c, err := snapshot.CredentialConfigFromGitConfig(context.Background(), u)
+	if err != nil {
+		t.Fatalf("CredentialConfigFromGitConfig: %v", err)
+	}
+	if want := "path-a-b@example.com"; c.Account != want {
+		t.Errorf("got account %q, want %q", c.Account, want)
+	}
+	// The scopes are collected from the least specific one.
+	if want := []string{"a", "b", "wildcard", "later"}; !reflect.DeepEqual(c.Scopes, want) {
+		t.Errorf("got scopes %q, want %q", c.Scopes, want)
+	}
+	if want := filepath.Join(home, "cache-a"); c.TokenCacheDir != want {
+		t.Errorf("got token cache directory %q, want %q", c.TokenCacheDir, want)
+	}
+
+	urls, err := snapshot.ListURLs(context.Background())
+	if err != nil {
+		t.Fatalf("ListURLs: %v", err)
+	}
+	if len(urls) != 9 {
+		t.Errorf("got %d URLs, want 9: %v", len(urls), urls)
+	}
+}
+
+func TestParseGitConfigList(t *testing.T) {
+	s, err := parseGitConfigList("file:/a\000google.account\nx@example.com\000command line:\000google.https://h.example.com/p.q.flag\000")
+	if err != nil {
+		t.Fatalf("parseGitConfigList: %v", err)
+	}
+	want := []gitConfigEntry{
+		{origin: "file:/a", section: "google", name: "account", value: "x@example.com"},
+		{origin: "command line:", section: "google", subsection: "https://h.example.com/p.q", name: "flag", noValue: true},
+	}
+	if !reflect.DeepEqual(s.entries, want) {
+		t.Errorf("got %+v, want %+v", s.entries, want)
+	}
+}
+
+func TestInMemoryConfig(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	// MakeToken applies GOOGLESOURCE_AUTH_*.
+	_, restore := setGitConfigEnv(t, "")
+	defer restore()
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	broker := filepath.Join(dir, "broker")
+	if err := ioutil.WriteFile(broker, []byte("#!/bin/sh\necho '{\"access_token\": \"token-'$1'\", \"expiry\": \"2100-01-02T03:04:05Z\"}'\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGitConfigSnapshot(
+		"google.account=exec:"+broker+" default",
+		"google.disableTokenCache",
+		"google.https://example.googlesource.com.account=exec:"+broker+" host",
+	)
+	if err != nil {
+		t.Fatalf("NewGitConfigSnapshot: %v", err)
+	}
+	if err := g.Add("google.https://example.googlesource.com/repo.scopes", "a,b"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	u := &url.URL{Scheme: "https", Host: "example.googlesource.com", Path: "/repo/sub"}
+	c, err := CredentialConfigFromConfig(context.Background(), g, u)
+	if err != nil {
+		t.Fatalf("CredentialConfigFromConfig: %v", err)
+	}
+	if c.TokenCacheDir != "" {
+		t.Errorf("got token cache directory %q, want it disabled", c.TokenCacheDir)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(c.Scopes, want) {
+		t.Errorf("got scopes %q, want %q", c.Scopes, want)
+	}
+
+	for _, tc := range []struct {
+		u    *url.URL
+		want string
+	}{
+		{u, "token-host"},
+		{&url.URL{Scheme: "https", Host: "other.googlesource.com"}, "token-default"},
+	} {
+		token, err := MakeToken(context.Background(), g, tc.u)
+		if err != nil {
+			t.Fatalf("MakeToken(%s): %v", tc.u, err)
+		}
+		if token.AccessToken != tc.want {
+			t.Errorf("MakeToken(%s) = %q, want %q", tc.u, token.AccessToken, tc.want)
+		}
+	}
+
+	if _, err := NewGitConfigSnapshot("invalid=x"); err == nil {
+		t.Error("NewGitConfigSnapshot accepts a key without a section")
+	}
+}
+
+func TestStringListConfigMultiValued(t *testing.T) {
+	g, _ := FindGitBinary()
+	if g.Path == "" {
+		t.Skip("requires git")
+	}
+	_, restore := setGitConfigEnv(t, `[google]
+	scopes = a
+	scopes = b, c
+[google "https://example.googlesource.com"]
+	scopes = host
+[google "https://reset.googlesource.com"]
+	scopes =
+	scopes = only
+[google]
+	scopes = d
+`)
+	defer restore()
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		url  string
+		want []string
+	}{
+		{"", []string{"a", "b", "c", "d"}},
+		{"https://example.googlesource.com/repo", []string{"a", "b", "c", "d", "host"}},
+		{"https://reset.googlesource.com/repo", []string{"only"}},
+	} {
+		var accessor GitConfigAccessor = g
+		if tc.url != "" {
+			u, _ := url.Parse(tc.url)
+			accessor = g.WithURL(u)
+		}
+		got, err := accessor.StringListConfig(ctx, "google.scopes")
+		if err != nil {
+			t.Fatalf("StringListConfig(%q): %v", tc.url, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("StringListConfig(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	_, restore := setGitConfigEnv(t, "")
+	defer restore()
+	defer os.Unsetenv("GOOGLESOURCE_AUTH_PROFILE")
+	configs := []string{
+		"google.account=global@example.com",
+		"google.scopes=global",
+		"google.gcloudConfiguration=global",
+		"googleProfile.ci.account=ci@example.iam.gserviceaccount.com",
+		"googleProfile.ci.serviceAccountDelegateEmails=hop@example.iam.gserviceaccount.com",
+		"googleProfile.ci.scopes=profile",
+		"googleProfile.other.account=other@example.com",
+		"google.https://a.googlesource.com.profile=ci",
+		"google.https://b.googlesource.com.profile=ci",
+		"google.https://b.googlesource.com.account=b@example.com",
+		"google.https://b.googlesource.com.scopes=b",
+		"google.https://c.googlesource.com.profile=undefined",
+	}
+	snapshot, err := NewGitConfigSnapshot(configs...)
+	if err != nil {
+		t.Fatalf("NewGitConfigSnapshot: %v", err)
+	}
+	accessors := map[string]URLScopedConfig{"snapshot": snapshot}
+	if g, _ := FindGitBinary(); g.Path != "" {
+		g.Configs = configs
+		accessors["git"] = g
+	}
+
+	for name, g := range accessors {
+		for _, tc := range []struct {
+			host          string
+			account       string
+			scopes        []string
+			delegates     []string
+			configuration string
+		}{
+			// The lists in the profile replace the global ones.
+			{"a.googlesource.com", "ci@example.iam.gserviceaccount.com", []string{"profile"}, []string{"hop@example.iam.gserviceaccount.com"}, "global"},
+			// URL-specific configs take precedence over the profile.
+			{"b.googlesource.com", "b@example.com", []string{"profile", "b"}, []string{"hop@example.iam.gserviceaccount.com"}, "global"},
+			{"other.googlesource.com", "global@example.com", []string{"global"}, nil, "global"},
+		} {
+			c, err := CredentialConfigFromConfig(context.Background(), g, &url.URL{Scheme: "https", Host: tc.host})
+			if err != nil {
+				t.Fatalf("%s: CredentialConfigFromConfig(%s): %v", name, tc.host, err)
+			}
+			if c.Account != tc.account {
+				t.Errorf("%s: %s: got account %q, want %q", name, tc.host, c.Account, tc.account)
+			}
+			if !reflect.DeepEqual(c.Scopes, tc.scopes) {
+				t.Errorf("%s: %s: got scopes %q, want %q", name, tc.host, c.Scopes, tc.scopes)
+			}
+			if !reflect.DeepEqual(c.ServiceAccountDelegateEmails, tc.delegates) {
+				t.Errorf("%s: %s: got delegates %q, want %q", name, tc.host, c.ServiceAccountDelegateEmails, tc.delegates)
+			}
+			if c.GcloudConfiguration != tc.configuration {
+				t.Errorf("%s: %s: got gcloud configuration %q, want %q", name, tc.host, c.GcloudConfiguration, tc.configuration)
+			}
+		}
+
+		if _, err := CredentialConfigFromConfig(context.Background(), g, &url.URL{Scheme: "https", Host: "c.googlesource.com"}); err == nil {
+			t.Errorf("%s: an undefined profile is accepted", name)
+		}
+		if v, err := g.StringConfig(context.Background(), "googleProfile.other.account"); err != nil || v != "other@example.com" {
+			t.Errorf("%s: StringConfig(googleProfile.other.account) = %q, %v, want other@example.com", name, v, err)
+		}
+
+		// GOOGLESOURCE_AUTH_PROFILE selects the profile for all URLs. The
+		// layer can be applied twice, e.g. by the caller and MakeToken.
+		os.Setenv("GOOGLESOURCE_AUTH_PROFILE", "ci")
+		for _, layered := range []URLScopedConfig{WithEnvOverrides(g), WithEnvOverrides(WithEnvOverrides(g))} {
+			c, err := CredentialConfigFromConfig(context.Background(), layered, &url.URL{Scheme: "https", Host: "other.googlesource.com"})
+			if err != nil {
+				t.Errorf("%s: CredentialConfigFromConfig with GOOGLESOURCE_AUTH_PROFILE: %v", name, err)
+			} else if c.Profile != "ci" || c.Account != "ci@example.iam.gserviceaccount.com" || !reflect.DeepEqual(c.Scopes, []string{"profile"}) {
+				t.Errorf("%s: got profile %q, account %q and scopes %q with GOOGLESOURCE_AUTH_PROFILE, want the ci profile", name, c.Profile, c.Account, c.Scopes)
+			}
+		}
+		os.Setenv("GOOGLESOURCE_AUTH_PROFILE", "undefined")
+		if _, err := CredentialConfigFromConfig(context.Background(), WithEnvOverrides(g), &url.URL{Scheme: "https", Host: "other.googlesource.com"}); err == nil {
+			t.Errorf("%s: an undefined profile in GOOGLESOURCE_AUTH_PROFILE is accepted", name)
+		}
+		os.Unsetenv("GOOGLESOURCE_AUTH_PROFILE")
+	}
+}
+
+func TestURLSpecificStringConfig(t *testing.T) {
+	_, restore := setGitConfigEnv(t, "")
+	defer restore()
+	// The environment variable is ignored.
+	os.Setenv("GOOGLESOURCE_AUTH_TOKEN_TYPE", TokenTypeIDToken)
+	defer os.Unsetenv("GOOGLESOURCE_AUTH_TOKEN_TYPE")
+	g, err := NewGitConfigSnapshot(
+		"google.tokenType=id_token",
+		"googleProfile.iap.tokenType=id_token",
+		"google.https://iap.example.com.tokenType=id_token",
+		"google.https://profile.example.com.profile=iap",
+	)
+	if err != nil {
+		t.Fatalf("NewGitConfigSnapshot: %v", err)
+	}
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"https://iap.example.com/repo", TokenTypeIDToken},
+		// The global config and the profile are not URL-specific.
+		{"https://github.com/repo", ""},
+		{"https://profile.example.com/repo", ""},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := g.URLSpecificStringConfig(context.Background(), u, "google.tokenType"); err != nil || got != tc.want {
+			t.Errorf("URLSpecificStringConfig(%s) = %q, %v, want %q", tc.url, got, err, tc.want)
+		}
+	}
+}
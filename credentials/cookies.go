@@ -22,6 +22,33 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// iapCookieName is the cookie that Identity-Aware Proxy reads an ID token
+// from.
+const iapCookieName = "GCP_IAAP_AUTH_TOKEN"
+
+// MakeCookiesFromConfig creates cookies for .gitcookies with a token made with
+// the config. ID tokens are set to the cookie for Identity-Aware Proxy of
+// the host. The other tokens are the same as MakeCookies.
+func MakeCookiesFromConfig(c *CredentialConfig, token *oauth2.Token) []*http.Cookie {
+	if c.TokenType != TokenTypeIDToken {
+		return MakeCookies(c.URL, token)
+	}
+	path := c.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	return []*http.Cookie{
+		{
+			Name:    iapCookieName,
+			Value:   token.AccessToken,
+			Path:    path,
+			Domain:  c.URL.Host,
+			Expires: token.Expiry,
+			Secure:  c.URL.Scheme == "https",
+		},
+	}
+}
+
 // MakeCookies create cookies for .gitcookies.
 func MakeCookies(u *url.URL, token *oauth2.Token) []*http.Cookie {
 	// N.B. nscjar adds #HttpOnly_ for HttpOnly cookies, and these prevent
@@ -0,0 +1,51 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestMakeCookiesFromConfig(t *testing.T) {
+	token := &oauth2.Token{AccessToken: "token"}
+	for _, tc := range []struct {
+		url       string
+		tokenType string
+		want      []string
+	}{
+		{"https://chromium.googlesource.com", "", []string{"o chromium.googlesource.com", "o chromium-review.googlesource.com"}},
+		{"https://gerrit.example.com", TokenTypeAccessToken, []string{"o gerrit.example.com"}},
+		{"https://gerrit.example.com", TokenTypeIDToken, []string{iapCookieName + " gerrit.example.com"}},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range MakeCookiesFromConfig(&CredentialConfig{URL: u, TokenType: tc.tokenType}, token) {
+			if c.Value != "token" || c.Path != "/" || !c.Secure {
+				t.Errorf("%s: unexpected cookie %+v", tc.url, c)
+			}
+			got = append(got, c.Name+" "+c.Domain)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s (%q): got cookies %q, want %q", tc.url, tc.tokenType, got, tc.want)
+		}
+	}
+}
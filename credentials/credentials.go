@@ -18,8 +18,8 @@ package credentials
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -35,102 +35,270 @@ import (
 )
 
 const (
-	scopeCloudPlatform = "https://www.googleapis.com/auth/cloud-platform"
+	scopeCloudPlatform    = "https://www.googleapis.com/auth/cloud-platform"
+	scopeGerritCodeReview = "https://www.googleapis.com/auth/gerritcodereview"
+	scopeSourceReadWrite  = "https://www.googleapis.com/auth/source.read_write"
+	scopeUserInfoEmail    = "https://www.googleapis.com/auth/userinfo.email"
 
-	accountApplicationDefault = "application-default"
-	accountGcloud             = "gcloud"
+	// defaultIAMTokenLifetime is the lifetime of the tokens minted by IAM
+	// Service Account Credentials API without a Lifetime.
+	defaultIAMTokenLifetime = time.Hour
+	// maxIAMTokenLifetime is the longest lifetime that IAM Service Account
+	// Credentials API accepts with the organization policy.
+	maxIAMTokenLifetime = 12 * time.Hour
 )
 
-// MakeToken creates a token for the given URL.
-func MakeToken(ctx context.Context, g GitBinary, u *url.URL) (*oauth2.Token, error) {
-	c, err := g.CredentialConfigFromGitConfig(ctx, u)
+// MakeToken creates a token for the given URL with the configs in g, which is
+// usually GitBinary. The environment variables override the configs. See
+// WithEnvOverrides.
+func MakeToken(ctx context.Context, g URLScopedConfig, u *url.URL) (*oauth2.Token, error) {
+	c, err := CredentialConfigFromConfig(ctx, WithEnvOverrides(g), u)
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get configs: %v", err)
+		return nil, xerrors.Errorf("credentials: cannot get configs: %w", err)
+	}
+	return MakeTokenFromConfig(ctx, c)
+}
+
+// MakeTokenFromConfig creates a token with the config. Unlike
+// TokenSourceFromConfig, this applies TokenTimeout.
+func MakeTokenFromConfig(ctx context.Context, c *CredentialConfig) (*oauth2.Token, error) {
+	if c.TokenTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.TokenTimeout)
+		defer cancel()
 	}
 	ts, err := TokenSourceFromConfig(ctx, c)
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get a TokenSource: %v", err)
+		return nil, xerrors.Errorf("credentials: cannot get a TokenSource: %w", err)
 	}
 	token, err := ts.Token()
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get a token: %v", err)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, xerrors.Errorf("credentials: cannot get a token in google.tokenTimeout (%v): %w", c.TokenTimeout, err)
+		}
+		return nil, xerrors.Errorf("credentials: cannot get a token: %w", err)
 	}
 	return token, nil
 }
 
 // TokenSourceFromConfig returns a TokenSource configured based on gitconfig.
 func TokenSourceFromConfig(ctx context.Context, c *CredentialConfig) (oauth2.TokenSource, error) {
-	account := c.Account
-	if account == "" {
-		c.Account = accountGcloud
+	accounts := c.Accounts
+	if len(accounts) == 0 {
+		var err error
+		accounts, err = ParseAccounts(c.Account)
+		if err != nil {
+			return nil, err
+		}
 	}
 	scopes := c.Scopes
 	if len(scopes) == 0 {
-		scopes = []string{scopeCloudPlatform}
+		scopes = defaultScopes(c.URL)
 	}
 
-	switch {
-	case account == accountGcloud:
-		return newGcloudTokenSource(ctx, c, "")
+	var newSource func(account Account) (oauth2.TokenSource, error)
+	switch c.TokenType {
+	case "", TokenTypeAccessToken:
+		newSource = func(account Account) (oauth2.TokenSource, error) {
+			return newTokenSource(ctx, c, account, scopes)
+		}
+	case TokenTypeIDToken:
+		newSource = func(account Account) (oauth2.TokenSource, error) {
+			return newIDTokenSource(ctx, c, account)
+		}
+	default:
+		return nil, xerrors.Errorf("credentials: unknown token type %q", c.TokenType)
+	}
 
-	case account == accountApplicationDefault:
-		// Use the application default credentials.
-		ts, err := google.DefaultTokenSource(ctx, scopes...)
+	var ts oauth2.TokenSource
+	key, cacheable := cacheKey(c, accounts, scopes)
+	if len(accounts) == 1 {
+		var err error
+		ts, err = newSource(accounts[0])
 		if err != nil {
-			return nil, xerrors.Errorf("credentials: cannot get the application default credentials: %v", err)
+			return nil, err
 		}
-		return ts, nil
+	} else {
+		statePath := ""
+		if c.TokenCacheDir != "" && cacheable {
+			statePath = filepath.Join(c.TokenCacheDir, key+".account")
+		}
+		ts = newFallbackTokenSource(ctx, accounts, statePath, newSource)
+	}
+	// The tokens are not cached if the account cannot be identified, so that
+	// a token of another identity is never reused.
+	if c.TokenCacheDir != "" && cacheable {
+		cached := newCachedTokenSource(ctx, c.TokenCacheDir, key, ts)
+		cached.minLifetime = c.MinTokenLifetime
+		ts = cached
+	}
+	return newMinLifetimeTokenSource(ts, c.MinTokenLifetime), nil
+}
 
-	case strings.HasSuffix(account, ".gserviceaccount.com"):
-		//Use IAM credentials API
-		ts, err := google.DefaultTokenSource(ctx, scopeCloudPlatform)
-		if err != nil {
-			return nil, xerrors.Errorf("credentials: cannot get the application default credentials: %v", err)
+// defaultScopes returns the OAuth2 scopes used when google.scopes is not
+// specified. The hosts known to accept narrower scopes get them, so that the
+// token given to a git server cannot call the other Google Cloud APIs.
+func defaultScopes(u *url.URL) []string {
+	if u != nil {
+		host := strings.ToLower(u.Hostname())
+		switch {
+		case host == "googlesource.com" || strings.HasSuffix(host, ".googlesource.com"):
+			return []string{scopeGerritCodeReview, scopeUserInfoEmail}
+		case host == "source.developers.google.com":
+			return []string{scopeSourceReadWrite, scopeUserInfoEmail}
 		}
+	}
+	return []string{scopeCloudPlatform}
+}
+
+func newTokenSource(ctx context.Context, c *CredentialConfig, account Account, scopes []string) (oauth2.TokenSource, error) {
+	switch account.Kind {
+	case AccountKindGcloud:
+		return newGcloudTokenSource(ctx, c, "")
+
+	case AccountKindUser:
+		return newGcloudTokenSource(ctx, c, account.Value)
 
-		svc, err := iamcredentials.NewService(ctx, option.WithTokenSource(ts))
+	case AccountKindApplicationDefault:
+		// Use the application default credentials.
+		return newRenewingTokenSource(func() (oauth2.TokenSource, error) {
+			ts, err := google.DefaultTokenSource(ctx, scopes...)
+			if err != nil {
+				return nil, xerrors.Errorf("credentials: cannot get the application default credentials: %w", err)
+			}
+			return ts, nil
+		}, c.MinTokenLifetime)
+
+	case AccountKindExternalAccount:
+		return newExternalAccountTokenSource(ctx, c, scopes)
+
+	case AccountKindMetadata:
+		return newMetadataTokenSource(ctx, c, account.Value, scopes), nil
+
+	case AccountKindKeyFile:
+		return newKeyFileTokenSource(ctx, c, account.Value, scopes)
+
+	case AccountKindExec:
+		return newExecTokenSource(ctx, c, account.Value, scopes)
+
+	case AccountKindServiceAccount:
+		//Use IAM credentials API
+		ts, err := newImpersonationSource(ctx, c)
 		if err != nil {
-			return nil, xerrors.Errorf("credentials: cannot create an IAM Service Account Credentials API client: %v", err)
+			return nil, err
 		}
+		return newIAMCredentialsTokenSource(ctx, ts, account.Value, c.ServiceAccountDelegateEmails, scopes, c)
+	}
+	return nil, xerrors.Errorf("credentials: unknown account kind %q", account.Kind)
+}
 
-		ds := []string{}
-		for _, d := range c.ServiceAccountDelegateEmails {
-			ds = append(ds, fmt.Sprintf("projects/-/serviceAccounts/%s", d))
+// newImpersonationSource returns a TokenSource of the credentials that
+// impersonate service accounts, as specified in ImpersonationSource.
+func newImpersonationSource(ctx context.Context, c *CredentialConfig) (oauth2.TokenSource, error) {
+	if c.ImpersonationSource == "" {
+		return newTokenSource(ctx, c, Account{Kind: AccountKindApplicationDefault}, []string{scopeCloudPlatform})
+	}
+	source, err := ParseAccount(c.ImpersonationSource)
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: invalid google.impersonationSource: %w", err)
+	}
+	switch source.Kind {
+	case AccountKindApplicationDefault, AccountKindGcloud, AccountKindUser:
+		return newTokenSource(ctx, c, source, []string{scopeCloudPlatform})
+	case AccountKindServiceAccount:
+		return nil, xerrors.Errorf("credentials: google.impersonationSource cannot be a service account (%s). Use google.serviceAccountDelegateEmails for a delegation chain", source.Value)
+	}
+	return nil, xerrors.Errorf("credentials: %s is not supported for google.impersonationSource", source)
+}
+
+func newGcloudTokenSource(ctx context.Context, c *CredentialConfig, name string) (oauth2.TokenSource, error) {
+	var ts oauth2.TokenSource
+	gcloud, err := newGcloudCommand(c)
+	if err == nil {
+		ts = &gcloudTokenSource{
+			ctx:         ctx,
+			name:        name,
+			gcloud:      gcloud,
+			minLifetime: c.MinTokenLifetime,
 		}
-		return oauth2.ReuseTokenSource(nil, &iamCredentialsTokenSource{
-			name:           fmt.Sprintf("projects/-/serviceAccounts/%s", account),
-			delegates:      ds,
-			scopes:         scopes,
-			iamCredService: iamcredentials.NewProjectsServiceAccountsService(svc),
-		}), nil
+	}
+	if c.UseGcloudCredentialStore {
+		// gcloud is needed only if the store cannot be read.
+		return newMinLifetimeTokenSource(&gcloudStoreTokenSource{
+			ctx:           ctx,
+			name:          name,
+			configDir:     c.GcloudConfigDir,
+			configuration: c.GcloudConfiguration,
+			minLifetime:   c.MinTokenLifetime,
+			fallback:      ts,
+			fallbackErr:   err,
+		}, c.MinTokenLifetime), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newMinLifetimeTokenSource(ts, c.MinTokenLifetime), nil
+}
 
-	default:
-		return newGcloudTokenSource(ctx, c, account)
+// gcloudCommand runs gcloud with the configuration specified in the config.
+type gcloudCommand struct {
+	path          string
+	configuration string
+	configDir     string
+}
+
+func newGcloudCommand(c *CredentialConfig) (*gcloudCommand, error) {
+	gcloudPath, err := findGcloud(c)
+	if err != nil {
+		return nil, err
 	}
+	return &gcloudCommand{
+		path:          gcloudPath,
+		configuration: c.GcloudConfiguration,
+		configDir:     c.GcloudConfigDir,
+	}, nil
 }
 
-func newGcloudTokenSource(ctx context.Context, c *CredentialConfig, name string) (oauth2.TokenSource, error) {
+// run runs gcloud with the arguments and returns its stdout.
+func (g *gcloudCommand) run(ctx context.Context, args ...string) ([]byte, error) {
+	if g.configuration != "" {
+		args = append([]string{"--configuration=" + g.configuration}, args...)
+	}
+	cmd := exec.CommandContext(ctx, g.path, args...)
+	if g.configDir != "" {
+		cmd.Env = append(os.Environ(), "CLOUDSDK_CONFIG="+g.configDir)
+	}
+	bs, err := runGcloud(cmd)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return bs, nil
+}
+
+// findGcloud returns an absolute path to the gcloud binary.
+func findGcloud(c *CredentialConfig) (string, error) {
 	gcloudPath := c.GcloudPath
 	var err error
 	if gcloudPath == "" {
 		gcloudPath, err = exec.LookPath("gcloud")
 		if err != nil {
-			return nil, xerrors.Errorf("credentials: cannot find the gcloud binary: %v", err)
+			return "", xerrors.Errorf("credentials: cannot find the gcloud binary (%v): %w", err, ErrGcloudNotFound)
 		}
 	}
 	gcloudPath, err = filepath.Abs(gcloudPath)
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot get an absolute path to gcloud: %v", err)
+		return "", xerrors.Errorf("credentials: cannot get an absolute path to gcloud: %w", err)
 	}
-	return oauth2.ReuseTokenSource(nil, &gcloudTokenSource{
-		name:       name,
-		gcloudPath: gcloudPath,
-	}), nil
+	return gcloudPath, nil
 }
 
 type gcloudTokenSource struct {
-	name       string
-	gcloudPath string
+	ctx    context.Context
+	name   string
+	gcloud *gcloudCommand
+	// If the token from print-access-token expires sooner than this, a new
+	// token is forced.
+	minLifetime time.Duration
 }
 
 func (s *gcloudTokenSource) Token() (*oauth2.Token, error) {
@@ -140,58 +308,161 @@ func (s *gcloudTokenSource) Token() (*oauth2.Token, error) {
 	if s.name != "" {
 		ss = append(ss, s.name)
 	}
-	cmd := exec.CommandContext(context.Background(), s.gcloudPath, ss...)
-	cmd.Stderr = os.Stderr
-	bs, err := cmd.Output()
+	bs, err := s.gcloud.run(s.ctx, ss...)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := parseGcloudOutput(bs)
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: failed to run gcloud: %v", err)
+		// The output format of print-access-token differs among gcloud
+		// versions. config-helper has a stable format for the tools.
+		var helperErr error
+		token, helperErr = s.configHelper(false)
+		if helperErr != nil {
+			return nil, xerrors.Errorf("credentials: cannot parse the gcloud print-access-token result (%v), and gcloud config config-helper failed: %w", err, helperErr)
+		}
+	}
+	if token.Expiry.IsZero() {
+		token.Expiry = accessTokenExpiry(s.ctx, token.AccessToken)
+	}
+	if s.minLifetime > 0 && time.Until(token.Expiry) < s.minLifetime {
+		// gcloud returns its cached token until shortly before it
+		// expires. If forcing a refresh fails, the token is still
+		// usable.
+		if refreshed, err := s.configHelper(true); err == nil && !refreshed.Expiry.IsZero() {
+			token = refreshed
+		}
 	}
+	return token, nil
+}
 
-	cred := &gcloudCredential{}
-	if err := json.Unmarshal(bs, cred); err != nil {
-		return nil, xerrors.Errorf("credentials: failed to parse gcloud print-access-token result: %v", err)
+// configHelper obtains a token with `gcloud config config-helper`.
+func (s *gcloudTokenSource) configHelper(forceRefresh bool) (*oauth2.Token, error) {
+	args := []string{"--format=json", "config", "config-helper"}
+	if forceRefresh {
+		args = append(args, "--force-auth-refresh")
 	}
-	if cred.AccessToken == "" || cred.TokenExpiry.DateTime == "" {
-		return nil, xerrors.Errorf("credentials: incomplete gcloud print-access-token result: %v", cred)
+	if s.name != "" {
+		args = append(args, "--account="+s.name)
 	}
-	expiry, err := time.Parse("2006-01-02 15:04:05.000000", cred.TokenExpiry.DateTime)
+	bs, err := s.gcloud.run(s.ctx, args...)
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot parse TokenExpiry: %v", err)
+		return nil, err
 	}
-	return &oauth2.Token{
-		AccessToken: cred.AccessToken,
-		Expiry:      expiry,
-	}, nil
+	token, err := parseGcloudOutput(bs)
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot parse the gcloud config config-helper result: %w", err)
+	}
+	return token, nil
+}
+
+// iamCredentialsEndpoint overrides the endpoint of IAM Service Account
+// Credentials API in tests.
+var iamCredentialsEndpoint = ""
+
+func newIAMCredentialsService(ctx context.Context, source oauth2.TokenSource) (*iamcredentials.Service, error) {
+	opts := []option.ClientOption{option.WithTokenSource(source)}
+	if iamCredentialsEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(iamCredentialsEndpoint))
+	}
+	return iamcredentials.NewService(ctx, opts...)
 }
 
-type gcloudCredential struct {
-	AccessToken string `json:"access_token"`
-	TokenExpiry struct {
-		DateTime string `json:"datetime"`
-	} `json:"token_expiry"`
+// newIAMCredentialsTokenSource returns a TokenSource that uses IAM Service
+// Account Credentials API to obtain the credentials of the service account.
+// The source TokenSource must have the cloud-platform scope.
+//
+// The lifetime of the tokens is decided by iamTokenLifetime from the config.
+func newIAMCredentialsTokenSource(ctx context.Context, source oauth2.TokenSource, account string, delegates, scopes []string, c *CredentialConfig) (oauth2.TokenSource, error) {
+	lifetime, err := iamTokenLifetime(c.TokenLifetime, c.MinTokenLifetime)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := newIAMCredentialsService(ctx, source)
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot create an IAM Service Account Credentials API client: %w", err)
+	}
+
+	ds := []string{}
+	for _, d := range delegates {
+		ds = append(ds, fmt.Sprintf("projects/-/serviceAccounts/%s", d))
+	}
+	return newMinLifetimeTokenSource(&iamCredentialsTokenSource{
+		ctx:            ctx,
+		name:           fmt.Sprintf("projects/-/serviceAccounts/%s", account),
+		delegates:      ds,
+		scopes:         scopes,
+		lifetime:       lifetime,
+		iamCredService: iamcredentials.NewProjectsServiceAccountsService(svc),
+	}, c.MinTokenLifetime), nil
 }
 
 type iamCredentialsTokenSource struct {
-	name           string
-	delegates      []string
-	scopes         []string
+	ctx       context.Context
+	name      string
+	delegates []string
+	scopes    []string
+	// lifetime is the requested token lifetime in the Duration JSON
+	// format, or empty for the default.
+	lifetime       string
 	iamCredService *iamcredentials.ProjectsServiceAccountsService
 }
 
 func (s *iamCredentialsTokenSource) Token() (*oauth2.Token, error) {
-	resp, err := s.iamCredService.GenerateAccessToken(s.name, &iamcredentials.GenerateAccessTokenRequest{
-		Delegates: s.delegates,
-		Scope:     s.scopes,
-	}).Context(context.Background()).Do()
+	var resp *iamcredentials.GenerateAccessTokenResponse
+	err := retryTransient(s.ctx, func() error {
+		var err error
+		resp, err = s.iamCredService.GenerateAccessToken(s.name, &iamcredentials.GenerateAccessTokenRequest{
+			Delegates: s.delegates,
+			Scope:     s.scopes,
+			Lifetime:  s.lifetime,
+		}).Context(s.ctx).Do()
+		if err != nil {
+			return newAPIError("IAM Service Account Credentials API", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot obtain a credential: %v", err)
+		var ae *APIError
+		if s.lifetime != "" && xerrors.As(err, &ae) && ae.Code == http.StatusBadRequest {
+			return nil, xerrors.Errorf("credentials: IAM rejected the token lifetime %s for %s. Lifetimes over one hour require the constraints/iam.allowServiceAccountCredentialLifetimeExtension organization policy. Check google.tokenLifetime and google.minTokenLifetime: %w", s.lifetime, s.name, err)
+		}
+		return nil, xerrors.Errorf("credentials: cannot obtain a credential for %s: %w", s.name, err)
 	}
 	expiry, err := time.Parse(time.RFC3339Nano, resp.ExpireTime)
 	if err != nil {
-		return nil, xerrors.Errorf("credentials: cannot parse ExpireTime: %v", err)
+		return nil, xerrors.Errorf("credentials: cannot parse ExpireTime: %w", err)
 	}
 	return &oauth2.Token{
 		AccessToken: resp.AccessToken,
 		Expiry:      expiry,
 	}, nil
 }
+
+// iamTokenLifetime returns the lifetime to request to IAM Service Account
+// Credentials API in the Duration JSON format, or empty for the default.
+//
+// tokenLifetime is used as is if specified. Otherwise, a longer lifetime than
+// the default is requested if needed so that the token is valid for
+// minLifetime after it's cached.
+func iamTokenLifetime(tokenLifetime, minLifetime time.Duration) (string, error) {
+	lifetime := tokenLifetime
+	if lifetime > 0 {
+		if lifetime < time.Second || lifetime > maxIAMTokenLifetime {
+			return "", xerrors.Errorf("credentials: google.tokenLifetime must be between 1s and %v, but it's %v", maxIAMTokenLifetime, lifetime)
+		}
+		if lifetime <= minLifetime {
+			return "", xerrors.Errorf("credentials: google.tokenLifetime (%v) must be longer than google.minTokenLifetime (%v)", lifetime, minLifetime)
+		}
+	} else {
+		lifetime = minLifetime + cachedTokenExpiryDelta
+		if lifetime <= defaultIAMTokenLifetime {
+			return "", nil
+		}
+		if lifetime > maxIAMTokenLifetime {
+			return "", xerrors.Errorf("credentials: google.minTokenLifetime must be at most %v for service accounts, but it's %v", maxIAMTokenLifetime-cachedTokenExpiryDelta, minLifetime)
+		}
+	}
+	return fmt.Sprintf("%ds", int64(lifetime.Round(time.Second)/time.Second)), nil
+}
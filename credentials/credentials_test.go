@@ -0,0 +1,273 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+	"google.golang.org/api/iamcredentials/v1"
+)
+
+func TestMakeTokenTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	g, _ := FindGitBinary()
+	if g.Path == "" {
+		t.Skip("requires git")
+	}
+	_, restore := setGitConfigEnv(t, "")
+	defer restore()
+	dir, err := ioutil.TempDir("", "gcloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A gcloud that hangs, e.g. waiting for reauthentication.
+	gcloud := filepath.Join(dir, "gcloud")
+	if err := ioutil.WriteFile(gcloud, []byte("#!/bin/sh\nexec sleep 60\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	g.Configs = []string{
+		"google.gcloudPath=" + gcloud,
+		"google.tokenTimeout=500ms",
+		"google.disableTokenCache=true",
+	}
+	start := time.Now()
+	_, err = MakeToken(context.Background(), g, &url.URL{Scheme: "https", Host: "example.googlesource.com"})
+	if !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MakeToken() = %v, want a deadline exceeded error", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("MakeToken() took %v, want it to stop at google.tokenTimeout", d)
+	}
+}
+
+func TestGcloudConfiguration(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	dir, err := ioutil.TempDir("", "gcloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A gcloud that returns its first argument and CLOUDSDK_CONFIG as the
+	// token.
+	gcloud := filepath.Join(dir, "gcloud")
+	script := `#!/bin/sh
+echo "{\"access_token\": \"$1 $CLOUDSDK_CONFIG\", \"token_expiry\": {\"datetime\": \"2099-01-01 00:00:00.000000\"}}"
+`
+	if err := ioutil.WriteFile(gcloud, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		configuration string
+		configDir     string
+		want          string
+	}{
+		{"default", "", "", "--format=json "},
+		{"configuration", "work", "", "--configuration=work "},
+		{"config dir", "", "/tmp/gcloud-work", "--format=json /tmp/gcloud-work"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+				GcloudPath:          gcloud,
+				GcloudConfiguration: tc.configuration,
+				GcloudConfigDir:     tc.configDir,
+			})
+			if err != nil {
+				t.Fatalf("TokenSourceFromConfig: %v", err)
+			}
+			token, err := ts.Token()
+			if err != nil {
+				t.Fatalf("Token: %v", err)
+			}
+			if token.AccessToken != tc.want {
+				t.Errorf("got %q, want %q", token.AccessToken, tc.want)
+			}
+		})
+	}
+}
+
+func TestImpersonationSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/v1/projects/-/serviceAccounts/ci@example.iam.gserviceaccount.com:generateAccessToken"; got != want {
+			t.Errorf("got path %q, want %q", got, want)
+		}
+		req := &iamcredentials.GenerateAccessTokenRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("cannot parse the request: %v", err)
+		}
+		if want := []string{"projects/-/serviceAccounts/hop@example.iam.gserviceaccount.com"}; !reflect.DeepEqual(req.Delegates, want) {
+			t.Errorf("got delegates %q, want %q", req.Delegates, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"accessToken": "impersonated by %s", "expireTime": "2099-01-01T00:00:00Z"}`, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	}))
+	defer srv.Close()
+	defer func(e string) { iamCredentialsEndpoint = e }(iamCredentialsEndpoint)
+	iamCredentialsEndpoint = srv.URL + "/"
+
+	dir, err := ioutil.TempDir("", "gcloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A gcloud that returns the account name as the token.
+	gcloud := filepath.Join(dir, "gcloud")
+	script := `#!/bin/sh
+echo "{\"token\": \"gcloud:$4\", \"expiry\": \"2099-01-01T00:00:00Z\"}"
+`
+	if err := ioutil.WriteFile(gcloud, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		source string
+		want   string
+	}{
+		{"gcloud", "impersonated by gcloud:"},
+		{"user@example.com", "impersonated by gcloud:user@example.com"},
+	} {
+		t.Run(tc.source, func(t *testing.T) {
+			ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+				Account:                      "ci@example.iam.gserviceaccount.com",
+				ServiceAccountDelegateEmails: []string{"hop@example.iam.gserviceaccount.com"},
+				ImpersonationSource:          tc.source,
+				GcloudPath:                   gcloud,
+			})
+			if err != nil {
+				t.Fatalf("TokenSourceFromConfig: %v", err)
+			}
+			token, err := ts.Token()
+			if err != nil {
+				t.Fatalf("Token: %v", err)
+			}
+			if token.AccessToken != tc.want {
+				t.Errorf("got %q, want %q", token.AccessToken, tc.want)
+			}
+		})
+	}
+
+	if _, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+		Account:             "ci@example.iam.gserviceaccount.com",
+		ImpersonationSource: "other@example.iam.gserviceaccount.com",
+	}); err == nil {
+		t.Error("a service account as the source is accepted")
+	}
+}
+
+func TestTokenLifetime(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &iamcredentials.GenerateAccessTokenRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("cannot parse the request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if req.Lifetime == "43200s" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"code": 400, "message": "Lifetime must be less than or equal to 3600s", "status": "INVALID_ARGUMENT"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"accessToken": "lifetime %s", "expireTime": "2099-01-01T00:00:00Z"}`, req.Lifetime)
+	}))
+	defer srv.Close()
+	defer func(e string) { iamCredentialsEndpoint = e }(iamCredentialsEndpoint)
+	iamCredentialsEndpoint = srv.URL + "/"
+	source := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "source"})
+
+	ts, err := newIAMCredentialsTokenSource(context.Background(), source, "ci@example.iam.gserviceaccount.com", nil, nil, &CredentialConfig{TokenLifetime: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("newIAMCredentialsTokenSource: %v", err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if want := "lifetime 600s"; token.AccessToken != want {
+		t.Errorf("got %q, want %q", token.AccessToken, want)
+	}
+
+	ts, err = newIAMCredentialsTokenSource(context.Background(), source, "ci@example.iam.gserviceaccount.com", nil, nil, &CredentialConfig{TokenLifetime: 12 * time.Hour})
+	if err != nil {
+		t.Fatalf("newIAMCredentialsTokenSource: %v", err)
+	}
+	_, err = ts.Token()
+	if err == nil || !strings.Contains(err.Error(), "allowServiceAccountCredentialLifetimeExtension") {
+		t.Errorf("got %v, want an error that mentions the organization policy", err)
+	}
+}
+
+func TestDefaultScopes(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want []string
+	}{
+		{"https://example.googlesource.com/repo", []string{scopeGerritCodeReview, scopeUserInfoEmail}},
+		{"https://example-review.googlesource.com/", []string{scopeGerritCodeReview, scopeUserInfoEmail}},
+		{"https://source.developers.google.com/p/project/r/repo", []string{scopeSourceReadWrite, scopeUserInfoEmail}},
+		{"https://example.com/repo", []string{scopeCloudPlatform}},
+		{"https://notgooglesource.com/repo", []string{scopeCloudPlatform}},
+	} {
+		u, _ := url.Parse(tc.url)
+		if got := defaultScopes(u); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("defaultScopes(%s) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+
+	u := &url.URL{Scheme: "https", Host: "example.googlesource.com"}
+	for _, tc := range []struct {
+		configs []string
+		want    []string
+	}{
+		{nil, []string{scopeGerritCodeReview, scopeUserInfoEmail}},
+		// Explicit google.scopes overrides the default.
+		{[]string{"google.scopes=" + scopeCloudPlatform}, []string{scopeCloudPlatform}},
+	} {
+		g, err := NewGitConfigSnapshot(tc.configs...)
+		if err != nil {
+			t.Fatalf("NewGitConfigSnapshot: %v", err)
+		}
+		c, err := CredentialConfigFromConfig(context.Background(), g, u)
+		if err != nil {
+			t.Fatalf("CredentialConfigFromConfig: %v", err)
+		}
+		if !reflect.DeepEqual(c.Scopes, tc.want) {
+			t.Errorf("%q: got scopes %q, want %q", tc.configs, c.Scopes, tc.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// envConfigPrefix is the prefix of the environment variables that override
+// the `google.*` configs.
+const envConfigPrefix = "GOOGLESOURCE_AUTH_"
+
+// WithEnvOverrides layers the environment variables over the config. A
+// `google.*` config is taken from the environment variable
+// `GOOGLESOURCE_AUTH_<NAME>` if it's set and not empty, where NAME is the
+// config name in upper snake case, e.g. `GOOGLESOURCE_AUTH_ACCOUNT` for
+// `google.account` and `GOOGLESOURCE_AUTH_MIN_TOKEN_LIFETIME` for
+// `google.minTokenLifetime`. The environment variables apply to all URLs, and
+// take precedence over any config in g including the URL-specific ones.
+// `GOOGLESOURCE_AUTH_PROFILE` also selects the profile that the other configs
+// are read from.
+// Layering it twice is the same as once.
+func WithEnvOverrides(g URLScopedConfig) URLScopedConfig {
+	if _, ok := g.(envConfig); ok {
+		return g
+	}
+	return envConfig{g}
+}
+
+type envConfig struct {
+	base URLScopedConfig
+}
+
+func (e envConfig) snapshotConfig(ctx context.Context) (URLScopedConfig, error) {
+	s, ok := e.base.(snapshotter)
+	if !ok {
+		return e, nil
+	}
+	base, err := s.snapshotConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return envConfig{base}, nil
+}
+
+func (e envConfig) WithURL(u *url.URL) GitConfigAccessor {
+	base := e.base.WithURL(u)
+	// GOOGLESOURCE_AUTH_PROFILE selects the profile that the configs are read
+	// from, not only the value of google.profile.
+	if profile, ok := (envAccessor{}).lookup("google.profile"); ok {
+		p, ok := base.(profileOverrider)
+		if !ok {
+			return envAccessor{err: xerrors.Errorf("credentials: %s is not supported for this config", envConfigName("google.profile"))}
+		}
+		base = p.withProfile(profile)
+	}
+	return envAccessor{base: base}
+}
+
+func (e envConfig) BoolConfig(ctx context.Context, key string) (bool, error) {
+	return e.WithURL(nil).BoolConfig(ctx, key)
+}
+
+func (e envConfig) PathConfig(ctx context.Context, key string) (string, error) {
+	return e.WithURL(nil).PathConfig(ctx, key)
+}
+
+func (e envConfig) StringConfig(ctx context.Context, key string) (string, error) {
+	return e.WithURL(nil).StringConfig(ctx, key)
+}
+
+func (e envConfig) StringListConfig(ctx context.Context, key string) ([]string, error) {
+	return e.WithURL(nil).StringListConfig(ctx, key)
+}
+
+type envAccessor struct {
+	base GitConfigAccessor
+	// err is returned for any config if set.
+	err error
+}
+
+// profileOverrider is implemented by the accessors that resolve
+// `google.profile`. withProfile returns the accessor that reads the configs
+// from the profile instead of the one in `google.profile`.
+type profileOverrider interface {
+	withProfile(profile string) GitConfigAccessor
+}
+
+// lookup returns the value of the environment variable for the key.
+func (e envAccessor) lookup(key string) (string, bool) {
+	name := envConfigName(key)
+	if name == "" {
+		return "", false
+	}
+	v := strings.TrimSpace(os.Getenv(name))
+	return v, v != ""
+}
+
+func (e envAccessor) BoolConfig(ctx context.Context, key string) (bool, error) {
+	if e.err != nil {
+		return false, e.err
+	}
+	v, ok := e.lookup(key)
+	if !ok {
+		return e.base.BoolConfig(ctx, key)
+	}
+	b, err := parseGitBool(v)
+	if err != nil {
+		return false, xerrors.Errorf("credentials: bad boolean value %q in %s: %w", v, envConfigName(key), err)
+	}
+	return b, nil
+}
+
+func (e envAccessor) PathConfig(ctx context.Context, key string) (string, error) {
+	if e.err != nil {
+		return "", e.err
+	}
+	v, ok := e.lookup(key)
+	if !ok {
+		return e.base.PathConfig(ctx, key)
+	}
+	p, err := expandGitPath(v)
+	if err != nil {
+		return "", xerrors.Errorf("credentials: cannot expand %s %q: %w", envConfigName(key), v, err)
+	}
+	return p, nil
+}
+
+func (e envAccessor) StringConfig(ctx context.Context, key string) (string, error) {
+	if e.err != nil {
+		return "", e.err
+	}
+	v, ok := e.lookup(key)
+	if !ok {
+		return e.base.StringConfig(ctx, key)
+	}
+	return v, nil
+}
+
+func (e envAccessor) StringListConfig(ctx context.Context, key string) ([]string, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	v, ok := e.lookup(key)
+	if !ok {
+		return e.base.StringListConfig(ctx, key)
+	}
+	return splitStringList(v), nil
+}
+
+// envConfigName returns the environment variable for a `google.*` config, or
+// empty for the other configs. The config name is converted to upper snake
+// case, where a run of capitals is a word, e.g. `USE_SELF_SIGNED_JWT` for
+// `useSelfSignedJWT`.
+func envConfigName(key string) string {
+	section, subsection, name, ok := splitGitConfigKey(key)
+	if !ok || section != "google" || subsection != "" {
+		return ""
+	}
+	// splitGitConfigKey lowercases the name.
+	name = key[strings.LastIndexByte(key, '.')+1:]
+	var b strings.Builder
+	b.WriteString(envConfigPrefix)
+	isUpper := func(c byte) bool { return 'A' <= c && c <= 'Z' }
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if i > 0 && isUpper(c) {
+			prev := name[i-1]
+			nextLower := i+1 < len(name) && !isUpper(name[i+1])
+			if !isUpper(prev) || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		if c == '-' {
+			c = '_'
+		}
+		b.WriteString(strings.ToUpper(string(c)))
+	}
+	return b.String()
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEnvConfigName(t *testing.T) {
+	for key, want := range map[string]string{
+		"google.account":                       "GOOGLESOURCE_AUTH_ACCOUNT",
+		"google.minTokenLifetime":              "GOOGLESOURCE_AUTH_MIN_TOKEN_LIFETIME",
+		"google.useSelfSignedJWT":              "GOOGLESOURCE_AUTH_USE_SELF_SIGNED_JWT",
+		"google.allowHTTPForCredentialHelper":  "GOOGLESOURCE_AUTH_ALLOW_HTTP_FOR_CREDENTIAL_HELPER",
+		"google.externalAccountServiceAccount": "GOOGLESOURCE_AUTH_EXTERNAL_ACCOUNT_SERVICE_ACCOUNT",
+		"google.https://example.com.account":   "",
+		"credential.helper":                    "",
+	} {
+		if got := envConfigName(key); got != want {
+			t.Errorf("envConfigName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	_, restore := setGitConfigEnv(t, "")
+	defer restore()
+	g, err := NewGitConfigSnapshot(
+		"google.account=global@example.com",
+		"google.https://example.googlesource.com.account=host@example.com",
+		"google.https://example.googlesource.com.gcloudPath=/usr/bin/gcloud",
+		"google.scopes=a",
+	)
+	if err != nil {
+		t.Fatalf("NewGitConfigSnapshot: %v", err)
+	}
+	for k, v := range map[string]string{
+		"GOOGLESOURCE_AUTH_ACCOUNT":             "env@example.com",
+		"GOOGLESOURCE_AUTH_SCOPES":              "x, y",
+		"GOOGLESOURCE_AUTH_DISABLE_TOKEN_CACHE": "yes",
+		// Empty variables are ignored.
+		"GOOGLESOURCE_AUTH_GCLOUD_PATH": "",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	u := &url.URL{Scheme: "https", Host: "example.googlesource.com"}
+	c, err := CredentialConfigFromConfig(context.Background(), WithEnvOverrides(g), u)
+	if err != nil {
+		t.Fatalf("CredentialConfigFromConfig: %v", err)
+	}
+	if want := "env@example.com"; c.Account != want {
+		t.Errorf("got account %q, want %q", c.Account, want)
+	}
+	if want := []string{"x", "y"}; !reflect.DeepEqual(c.Scopes, want) {
+		t.Errorf("got scopes %q, want %q", c.Scopes, want)
+	}
+	if want := "/usr/bin/gcloud"; c.GcloudPath != want {
+		t.Errorf("got gcloud path %q, want %q", c.GcloudPath, want)
+	}
+	if c.TokenCacheDir != "" {
+		t.Errorf("got token cache directory %q, want it disabled", c.TokenCacheDir)
+	}
+
+	// Without the layer, the environment variables are not looked at.
+	c, err = CredentialConfigFromConfig(context.Background(), g, u)
+	if err != nil {
+		t.Fatalf("CredentialConfigFromConfig: %v", err)
+	}
+	if want := "host@example.com"; c.Account != want {
+		t.Errorf("got account %q without the layer, want %q", c.Account, want)
+	}
+
+	os.Setenv("GOOGLESOURCE_AUTH_DISABLE_TOKEN_CACHE", "maybe")
+	if _, err := CredentialConfigFromConfig(context.Background(), WithEnvOverrides(g), u); err == nil {
+		t.Error("an invalid boolean in the environment variable is accepted")
+	}
+}
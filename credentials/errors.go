@@ -0,0 +1,305 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/api/googleapi"
+)
+
+// The classes of the errors returned from this package. Use xerrors.Is (or
+// errors.Is) to test an error against them.
+var (
+	// ErrGcloudNotFound means that the gcloud binary is not installed.
+	ErrGcloudNotFound = xerrors.New("gcloud is not installed")
+	// ErrNotLoggedIn means that the account has no valid credentials, e.g.
+	// it's not registered with `gcloud auth login`.
+	ErrNotLoggedIn = xerrors.New("not logged in")
+	// ErrReauthRequired means that the account must authenticate again,
+	// e.g. because of the session length policy.
+	ErrReauthRequired = xerrors.New("reauthentication required")
+	// ErrPermissionDenied means that the server rejected the request
+	// because of missing permissions, such as
+	// `iam.serviceAccounts.getAccessToken`.
+	ErrPermissionDenied = xerrors.New("permission denied")
+	// ErrTransient means that the request failed temporarily, e.g. because
+	// of a network error or an HTTP 5xx response. A retry may succeed.
+	ErrTransient = xerrors.New("transient failure")
+)
+
+// Exit codes of the commands for the error classes. They're stable so that
+// scripts can depend on them.
+const (
+	ExitCodeError            = 1
+	ExitCodeGcloudNotFound   = 3
+	ExitCodeNotLoggedIn      = 4
+	ExitCodeReauthRequired   = 5
+	ExitCodePermissionDenied = 6
+	ExitCodeTransient        = 7
+)
+
+const (
+	maxTransientRetries = 3
+	maxStderrInError    = 2048
+)
+
+// retryBackoff is the wait before the first retry. It's doubled for each
+// retry.
+var retryBackoff = 500 * time.Millisecond
+
+// CommandError is an error of an external command, such as gcloud.
+type CommandError struct {
+	// Path to the command.
+	Path string
+	// Args of the command, excluding the command itself.
+	Args []string
+	// ExitCode of the command. This is -1 if the command didn't exit
+	// normally.
+	ExitCode int
+	// Stderr output of the command.
+	Stderr string
+	// Class is one of the Err* errors, or nil if not classified.
+	Class error
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	s := fmt.Sprintf("credentials: %s %s failed: %v", filepath.Base(e.Path), strings.Join(e.Args, " "), e.Err)
+	if e.Stderr != "" {
+		stderr := e.Stderr
+		if len(stderr) > maxStderrInError {
+			stderr = "..." + stderr[len(stderr)-maxStderrInError:]
+		}
+		s += ": " + stderr
+	}
+	return s
+}
+
+// Is reports whether the error is classified as the target.
+func (e *CommandError) Is(target error) bool {
+	return e.Class != nil && e.Class == target
+}
+
+// Unwrap returns the underlying error.
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// APIError is an error returned from a Google API, such as IAM Service Account
+// Credentials API.
+type APIError struct {
+	// API is the name of the API.
+	API string
+	// Code is the HTTP status code, or zero if the request didn't reach the
+	// server.
+	Code int
+	// Message is the error message from the server.
+	Message string
+	// Class is one of the Err* errors, or nil if not classified.
+	Class error
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *APIError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("credentials: %s request failed: %v", e.API, e.Err)
+	}
+	return fmt.Sprintf("credentials: %s returned HTTP %d: %s", e.API, e.Code, e.Message)
+}
+
+// Is reports whether the error is classified as the target.
+func (e *APIError) Is(target error) bool {
+	return e.Class != nil && e.Class == target
+}
+
+// Unwrap returns the underlying error.
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code of the commands for the error.
+func ExitCode(err error) int {
+	switch {
+	case xerrors.Is(err, ErrGcloudNotFound):
+		return ExitCodeGcloudNotFound
+	case xerrors.Is(err, ErrNotLoggedIn):
+		return ExitCodeNotLoggedIn
+	case xerrors.Is(err, ErrReauthRequired):
+		return ExitCodeReauthRequired
+	case xerrors.Is(err, ErrPermissionDenied):
+		return ExitCodePermissionDenied
+	case xerrors.Is(err, ErrTransient):
+		return ExitCodeTransient
+	}
+	return ExitCodeError
+}
+
+// ErrorHint returns a message that tells the user how to fix the error, or an
+// empty string if there's no suggestion.
+func ErrorHint(err error) string {
+	switch {
+	case xerrors.Is(err, ErrGcloudNotFound):
+		return "Install Google Cloud SDK (https://cloud.google.com/sdk/), or specify the path to gcloud in google.gcloudPath."
+	case xerrors.Is(err, ErrNotLoggedIn):
+		return "Run `gcloud auth login`, or choose another account in google.account."
+	case xerrors.Is(err, ErrReauthRequired):
+		return "Run `gcloud auth login` to authenticate again."
+	case xerrors.Is(err, ErrPermissionDenied):
+		return "Make sure that the account has the required IAM roles. Impersonating a service account requires roles/iam.serviceAccountTokenCreator on it."
+	case xerrors.Is(err, ErrTransient):
+		return "This is likely a temporary problem. Try again later."
+	}
+	return ""
+}
+
+// runGcloud runs gcloud and returns its stdout. The stderr is captured into
+// the returned *CommandError, and the error is classified by it.
+func runGcloud(cmd *exec.Cmd) ([]byte, error) {
+	bs, err := runCommand(cmd)
+	if ce, ok := err.(*CommandError); ok {
+		ce.Class = classifyGcloudStderr(ce.Stderr)
+	}
+	return bs, err
+}
+
+// runCommand runs the command and returns its stdout. The stderr is captured
+// into the returned *CommandError.
+func runCommand(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	bs, err := cmd.Output()
+	if err == nil {
+		return bs, nil
+	}
+	ce := &CommandError{
+		Path:     cmd.Path,
+		Args:     cmd.Args[1:],
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Err:      err,
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		ce.ExitCode = ee.ExitCode()
+	}
+	return nil, ce
+}
+
+// contextError returns an error wrapping the context's error if the context is
+// done, e.g. when the command was killed at the deadline. Otherwise it returns
+// err as is.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return xerrors.Errorf("credentials: interrupted (%v): %w", err, ctxErr)
+	}
+	return err
+}
+
+// classifyGcloudStderr classifies the error by the messages from gcloud.
+func classifyGcloudStderr(stderr string) error {
+	s := strings.ToLower(stderr)
+	switch {
+	case strings.Contains(s, "reauthentication"),
+		strings.Contains(s, "invalid_rapt"),
+		strings.Contains(s, "reauth related error"):
+		return ErrReauthRequired
+	case strings.Contains(s, "you do not currently have an active account selected"),
+		strings.Contains(s, "does not have any valid credentials"),
+		strings.Contains(s, "there was a problem refreshing your current auth tokens"),
+		strings.Contains(s, "gcloud auth login"):
+		return ErrNotLoggedIn
+	case strings.Contains(s, "permission_denied"),
+		strings.Contains(s, "permission denied"):
+		return ErrPermissionDenied
+	case strings.Contains(s, "transporterror"),
+		strings.Contains(s, "connection reset"),
+		strings.Contains(s, "unable to find the server"),
+		strings.Contains(s, "timed out"):
+		return ErrTransient
+	}
+	return nil
+}
+
+// newAPIError wraps an error returned from a Google API client.
+func newAPIError(api string, err error) error {
+	ae := &APIError{API: api, Err: err}
+	if ge, ok := err.(*googleapi.Error); ok {
+		ae.Code = ge.Code
+		ae.Message = ge.Message
+		ae.Class = classifyHTTPStatus(ge.Code)
+		return ae
+	}
+	if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+		ae.Class = ErrTransient
+	} else if xerrors.As(err, new(*net.OpError)) {
+		ae.Class = ErrTransient
+	}
+	return ae
+}
+
+// newHTTPAPIError creates an error for a non-200 response of a Google API.
+func newHTTPAPIError(api string, code int, message string) error {
+	return &APIError{
+		API:     api,
+		Code:    code,
+		Message: message,
+		Class:   classifyHTTPStatus(code),
+		Err:     xerrors.New(http.StatusText(code)),
+	}
+}
+
+func classifyHTTPStatus(code int) error {
+	switch {
+	case code == http.StatusUnauthorized:
+		return ErrNotLoggedIn
+	case code == http.StatusForbidden:
+		return ErrPermissionDenied
+	case code == http.StatusTooManyRequests, code >= 500:
+		return ErrTransient
+	}
+	return nil
+}
+
+// retryTransient calls f until it succeeds or returns a non-transient error,
+// up to maxTransientRetries retries with an exponential backoff. It stops
+// retrying when the context is done.
+func retryTransient(ctx context.Context, f func() error) error {
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i == maxTransientRetries || !xerrors.Is(err, ErrTransient) {
+			return err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return contextError(ctx, err)
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
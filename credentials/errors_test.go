@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/api/googleapi"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"unclassified", xerrors.New("boom"), ExitCodeError},
+		{"gcloud not found", xerrors.Errorf("credentials: wrapped: %w", ErrGcloudNotFound), ExitCodeGcloudNotFound},
+		{"reauth", &CommandError{Class: classifyGcloudStderr("ERROR: Reauthentication required."), Err: xerrors.New("exit status 1")}, ExitCodeReauthRequired},
+		{"not logged in", &CommandError{Class: classifyGcloudStderr("ERROR: (gcloud.auth.print-access-token) You do not currently have an active account selected."), Err: xerrors.New("exit status 1")}, ExitCodeNotLoggedIn},
+		{"IAM permission denied", newAPIError("IAM", &googleapi.Error{Code: 403, Message: "Permission 'iam.serviceAccounts.getAccessToken' denied"}), ExitCodePermissionDenied},
+		{"HTTP 503", newHTTPAPIError("STS", 503, "unavailable"), ExitCodeTransient},
+		{"HTTP 400", newHTTPAPIError("STS", 400, "bad request"), ExitCodeError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ExitCode(tc.err); got != tc.want {
+				t.Errorf("ExitCode(%v) = %d, want %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunCommandCapturesStderr(t *testing.T) {
+	_, err := runCommand(exec.Command("sh", "-c", "echo oops >&2; exit 3"))
+	ce, ok := err.(*CommandError)
+	if !ok {
+		t.Fatalf("runCommand() error = %v, want *CommandError", err)
+	}
+	if ce.ExitCode != 3 || ce.Stderr != "oops" {
+		t.Errorf("runCommand() = exit %d, stderr %q, want exit 3, stderr \"oops\"", ce.ExitCode, ce.Stderr)
+	}
+	if !strings.Contains(err.Error(), "oops") {
+		t.Errorf("Error() = %q, want the stderr", err.Error())
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	calls := 0
+	err := retryTransient(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return newHTTPAPIError("IAM", 503, "unavailable")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("retryTransient() = %v after %d calls, want success after 3 calls", err, calls)
+	}
+
+	calls = 0
+	err = retryTransient(context.Background(), func() error {
+		calls++
+		return newHTTPAPIError("IAM", 403, "denied")
+	})
+	if !xerrors.Is(err, ErrPermissionDenied) || calls != 1 {
+		t.Errorf("retryTransient() = %v after %d calls, want permission denied after 1 call", err, calls)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	accountExecPrefix = "exec:"
+
+	defaultExecTimeout = time.Minute
+)
+
+// execTokenResponse is the output format of the `exec:` commands.
+type execTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+	// Expiry is an RFC 3339 timestamp.
+	Expiry string `json:"expiry"`
+	// ExpiresIn is the lifetime of the token in seconds. This is used if
+	// Expiry is empty.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// execTokenSource runs an external command and parses its output as a token.
+type execTokenSource struct {
+	ctx     context.Context
+	args    []string
+	env     []string
+	timeout time.Duration
+	idToken bool
+}
+
+func newExecTokenSource(ctx context.Context, c *CredentialConfig, command string, scopes []string) (oauth2.TokenSource, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot parse the command %q: %w", command, err)
+	}
+	if len(args) == 0 {
+		return nil, xerrors.New("credentials: exec: account requires a command")
+	}
+	for i, arg := range args {
+		args[i] = expandURL(arg, c.URL)
+	}
+
+	env := []string{
+		"GOOGLESOURCE_AUTH_REQUEST_SCOPES=" + strings.Join(scopes, " "),
+		"GOOGLESOURCE_AUTH_REQUEST_TOKEN_TYPE=" + c.TokenType,
+		"GOOGLESOURCE_AUTH_REQUEST_AUDIENCE=" + c.Audience,
+	}
+	if c.URL != nil {
+		env = append(env,
+			"GOOGLESOURCE_AUTH_REQUEST_URL="+c.URL.String(),
+			"GOOGLESOURCE_AUTH_REQUEST_PROTOCOL="+c.URL.Scheme,
+			"GOOGLESOURCE_AUTH_REQUEST_HOST="+c.URL.Host,
+			"GOOGLESOURCE_AUTH_REQUEST_PATH="+c.URL.Path,
+		)
+	}
+
+	timeout := c.ExecTimeout
+	if timeout == 0 {
+		timeout = defaultExecTimeout
+	}
+	return newMinLifetimeTokenSource(&execTokenSource{
+		ctx:     ctx,
+		args:    args,
+		env:     env,
+		timeout: timeout,
+		idToken: c.TokenType == TokenTypeIDToken,
+	}, c.MinTokenLifetime), nil
+}
+
+func (s *execTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.args[0], s.args[1:]...)
+	cmd.Env = append(os.Environ(), s.env...)
+	bs, err := runCommand(cmd)
+	if s.ctx.Err() != nil {
+		return nil, contextError(s.ctx, err)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, xerrors.Errorf("credentials: %s timed out after %v", s.args[0], s.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &execTokenResponse{}
+	if err := json.Unmarshal(bs, resp); err != nil {
+		return nil, xerrors.Errorf("credentials: cannot parse the output of %s: %w", s.args[0], err)
+	}
+	token := &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   resp.TokenType,
+	}
+	if s.idToken {
+		token.AccessToken = resp.IDToken
+	}
+	if token.AccessToken == "" {
+		return nil, xerrors.Errorf("credentials: %s returned no token", s.args[0])
+	}
+	switch {
+	case resp.Expiry != "":
+		token.Expiry, err = time.Parse(time.RFC3339, resp.Expiry)
+		if err != nil {
+			return nil, xerrors.Errorf("credentials: cannot parse the expiry returned by %s: %w", s.args[0], err)
+		}
+	case resp.ExpiresIn > 0:
+		token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	case s.idToken:
+		return idTokenToOAuth2Token(token.AccessToken)
+	}
+	return token, nil
+}
+
+// expandURL replaces %u, %s, %h and %p in the argument with the URL, the
+// scheme, the host and the path respectively. %% is replaced with %.
+func expandURL(arg string, u *url.URL) string {
+	if u == nil {
+		u = &url.URL{}
+	}
+	var b strings.Builder
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '%' || i+1 == len(arg) {
+			b.WriteByte(arg[i])
+			continue
+		}
+		i++
+		switch arg[i] {
+		case 'u':
+			b.WriteString(u.String())
+		case 's':
+			b.WriteString(u.Scheme)
+		case 'h':
+			b.WriteString(u.Host)
+		case 'p':
+			b.WriteString(u.Path)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(arg[i])
+		}
+	}
+	return b.String()
+}
+
+// splitCommand splits the command line by spaces. Single and double quotes
+// can be used for the arguments that contain spaces. A backslash escapes the
+// next character outside of single quotes.
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote == '\'':
+			if ch == '\'' {
+				quote = 0
+			} else {
+				cur.WriteByte(ch)
+			}
+		case ch == '\\':
+			if i+1 == len(s) {
+				return nil, xerrors.New("trailing backslash")
+			}
+			i++
+			cur.WriteByte(s[i])
+			inArg = true
+		case quote == '"':
+			if ch == '"' {
+				quote = 0
+			} else {
+				cur.WriteByte(ch)
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+			inArg = true
+		case ch == ' ' || ch == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(ch)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, xerrors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
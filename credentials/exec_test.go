@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "broker --host %h", want: []string{"broker", "--host", "%h"}},
+		{in: "  broker\t a  ", want: []string{"broker", "a"}},
+		{in: `"/opt/my broker/bin" 'a b' c\ d ""`, want: []string{"/opt/my broker/bin", "a b", "c d", ""}},
+		{in: `broker 'unterminated`, wantErr: true},
+	} {
+		got, err := splitCommand(tc.in)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("splitCommand(%q): got error %v, want error: %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestExecTokenSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "broker")
+	if err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+ok)
+  test "$2" = "$GOOGLESOURCE_AUTH_REQUEST_HOST" || exit 1
+  echo '{"access_token": "token-for-'$2'", "expiry": "2100-01-02T03:04:05Z"}'
+  ;;
+fail)
+  echo "not authorized" >&2
+  exit 2
+  ;;
+hang)
+  exec sleep 10
+  ;;
+esac
+`), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &url.URL{Scheme: "https", Host: "example.googlesource.com", Path: "/repo"}
+	for _, tc := range []struct {
+		name       string
+		command    string
+		want       string
+		wantErrMsg string
+	}{
+		{name: "ok", command: script + " ok %h", want: "token-for-example.googlesource.com"},
+		{name: "fail", command: script + " fail", wantErrMsg: "not authorized"},
+		{name: "timeout", command: script + " hang", wantErrMsg: "timed out"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+				URL:         u,
+				Account:     "exec:" + tc.command,
+				ExecTimeout: time.Second,
+			})
+			if err != nil {
+				t.Fatalf("TokenSourceFromConfig: %v", err)
+			}
+			token, err := ts.Token()
+			if tc.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErrMsg) {
+					t.Errorf("got error %v, want %q", err, tc.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Token: %v", err)
+			}
+			if token.AccessToken != tc.want {
+				t.Errorf("got %q, want %q", token.AccessToken, tc.want)
+			}
+			if want := time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC); !token.Expiry.Equal(want) {
+				t.Errorf("got expiry %v, want %v", token.Expiry, want)
+			}
+		})
+	}
+}
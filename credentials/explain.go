@@ -0,0 +1,157 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// ConfigSource is where a config value comes from.
+type ConfigSource struct {
+	// Key is the config key that has the value, such as
+	// `google.https://example.googlesource.com.account` and
+	// `googleprofile.ci.account`.
+	Key   string
+	Value string
+	// Origin is the origin in the format of `git config --show-origin`, such
+	// as `file:PATH` and `command line:`, or `env:NAME` for the environment
+	// variables.
+	Origin string
+	// Line is the line number in the file, or zero if unknown.
+	Line int
+}
+
+// ConfigExplanation is a CredentialConfig with the sources of the values.
+type ConfigExplanation struct {
+	Config *CredentialConfig
+	// Sources of the configs that have a value, in the order they are read.
+	// A list config can have multiple sources.
+	Sources []ConfigSource
+}
+
+// ExplainCredentialConfig resolves the CredentialConfig for the URL as
+// MakeToken does, and tells where each value comes from. This doesn't obtain
+// any token.
+func ExplainCredentialConfig(ctx context.Context, g URLScopedConfig, u *url.URL) (*ConfigExplanation, error) {
+	g, err := snapshotConfig(ctx, WithEnvOverrides(g))
+	if err != nil {
+		return nil, err
+	}
+	rec := &recordingAccessor{base: g.WithURL(u)}
+	c, err := credentialConfigFromAccessor(ctx, rec, u)
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigExplanation{Config: c, Sources: rec.sources}, nil
+}
+
+// sourcer is a GitConfigAccessor that can tell where the values come from.
+// If all is true, the sources of all the values of a list config are
+// returned. Otherwise, only the source of the effective value is returned.
+type sourcer interface {
+	configSources(key string, all bool) ([]ConfigSource, error)
+}
+
+// recordingAccessor records the sources of the configs read through it.
+type recordingAccessor struct {
+	base    GitConfigAccessor
+	sources []ConfigSource
+}
+
+func (r *recordingAccessor) record(key string, all bool) error {
+	s, ok := r.base.(sourcer)
+	if !ok {
+		return nil
+	}
+	sources, err := s.configSources(key, all)
+	if err != nil {
+		return err
+	}
+	r.sources = append(r.sources, sources...)
+	return nil
+}
+
+func (r *recordingAccessor) BoolConfig(ctx context.Context, key string) (bool, error) {
+	v, err := r.base.BoolConfig(ctx, key)
+	if err != nil {
+		return v, err
+	}
+	return v, r.record(key, false)
+}
+
+func (r *recordingAccessor) PathConfig(ctx context.Context, key string) (string, error) {
+	v, err := r.base.PathConfig(ctx, key)
+	if err != nil {
+		return v, err
+	}
+	return v, r.record(key, false)
+}
+
+func (r *recordingAccessor) StringConfig(ctx context.Context, key string) (string, error) {
+	v, err := r.base.StringConfig(ctx, key)
+	if err != nil {
+		return v, err
+	}
+	return v, r.record(key, false)
+}
+
+func (r *recordingAccessor) StringListConfig(ctx context.Context, key string) ([]string, error) {
+	v, err := r.base.StringListConfig(ctx, key)
+	if err != nil {
+		return v, err
+	}
+	return v, r.record(key, true)
+}
+
+func (a snapshotAccessor) configSources(key string, all bool) ([]ConfigSource, error) {
+	entries, err := a.lookupAll(key)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	if !all {
+		entries = entries[len(entries)-1:]
+	} else {
+		// The values before an empty value are reset.
+		for i := len(entries) - 1; i >= 0; i-- {
+			if strings.TrimSpace(entries[i].value) == "" {
+				entries = entries[i+1:]
+				break
+			}
+		}
+	}
+	a.snapshot.fillLines()
+	var sources []ConfigSource
+	for _, e := range entries {
+		sources = append(sources, ConfigSource{
+			Key:    e.key(),
+			Value:  e.value,
+			Origin: e.origin,
+			Line:   e.line,
+		})
+	}
+	return sources, nil
+}
+
+func (e envAccessor) configSources(key string, all bool) ([]ConfigSource, error) {
+	if v, ok := e.lookup(key); ok {
+		return []ConfigSource{{Key: key, Value: v, Origin: "env:" + envConfigName(key)}}, nil
+	}
+	if s, ok := e.base.(sourcer); ok {
+		return s.configSources(key, all)
+	}
+	return nil, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const explainGitConfig = `[googleProfile "ci"]
+	account = sa:ci@example.iam.gserviceaccount.com
+[google]
+	scopes = a
+	scopes = b
+[google "https://example.googlesource.com"]
+	profile = ci
+`
+
+func TestExplainCredentialConfig(t *testing.T) {
+	for _, withGit := range []bool{false, true} {
+		g, _ := FindGitBinary()
+		if withGit && g.Path == "" {
+			t.Skip("requires git")
+		}
+		if !withGit {
+			g = GitBinary{}
+		}
+		home, restore := setGitConfigEnv(t, explainGitConfig)
+		os.Setenv("GOOGLESOURCE_AUTH_TOKEN_TYPE", "bearer")
+		g.Configs = []string{"google.gcloudPath=/usr/bin/gcloud"}
+
+		u := &url.URL{Scheme: "https", Host: "example.googlesource.com"}
+		e, err := ExplainCredentialConfig(context.Background(), g, u)
+		os.Unsetenv("GOOGLESOURCE_AUTH_TOKEN_TYPE")
+		restore()
+		if err != nil {
+			t.Fatalf("ExplainCredentialConfig: %v", err)
+		}
+		if e.Config.Profile != "ci" || e.Config.TokenType != "bearer" || e.Config.Accounts[0].Value != "ci@example.iam.gserviceaccount.com" {
+			t.Errorf("got config %+v", e.Config)
+		}
+		file := "file:" + filepath.Join(home, ".gitconfig")
+		want := []ConfigSource{
+			{Key: "google.https://example.googlesource.com.profile", Value: "ci", Origin: file, Line: 7},
+			{Key: "googleprofile.ci.account", Value: "sa:ci@example.iam.gserviceaccount.com", Origin: file, Line: 2},
+			{Key: "google.scopes", Value: "a", Origin: file, Line: 4},
+			{Key: "google.scopes", Value: "b", Origin: file, Line: 5},
+			{Key: "google.gcloudpath", Value: "/usr/bin/gcloud", Origin: "command line:"},
+			{Key: "google.tokenType", Value: "bearer", Origin: "env:GOOGLESOURCE_AUTH_TOKEN_TYPE"},
+		}
+		if !reflect.DeepEqual(e.Sources, want) {
+			t.Errorf("withGit=%t: got sources\n%+v\nwant\n%+v", withGit, e.Sources, want)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultSTSEndpoint      = "https://sts.googleapis.com/v1/token"
+	defaultSubjectTokenType = "urn:ietf:params:oauth:token-type:jwt"
+
+	grantTypeTokenExchange   = "urn:ietf:params:oauth:grant-type:token-exchange"
+	requestedTokenTypeAccess = "urn:ietf:params:oauth:token-type:access_token"
+	subjectTokenExecTimeout  = 30 * time.Second
+	maxResponseSize          = 1 << 20
+)
+
+// ExternalAccountConfig is the configuration for Workload Identity Federation.
+// This is used when `Account` is `external-account`.
+type ExternalAccountConfig struct {
+	// The audience of the workload identity pool provider, such as
+	// `//iam.googleapis.com/projects/PROJECT_NUMBER/locations/global/workloadIdentityPools/POOL_ID/providers/PROVIDER_ID`.
+	Audience string
+
+	// The type of the subject token. If empty, it defaults to
+	// `urn:ietf:params:oauth:token-type:jwt`.
+	SubjectTokenType string
+
+	// A file that contains the subject token.
+	SubjectTokenFile string
+
+	// A URL that returns the subject token. Environment variables in the URL
+	// are expanded.
+	SubjectTokenURL string
+
+	// HTTP headers sent to `SubjectTokenURL` in the form of `NAME: VALUE`.
+	// Environment variables in the values are expanded.
+	SubjectTokenURLHeaders []string
+
+	// A command that prints the subject token. The command is split by
+	// spaces, and quotes can be used as in `exec:` accounts. It can print the
+	// token as is, or in the executable-sourced credentials JSON format.
+	SubjectTokenExecutable string
+
+	// If not empty, the content of `SubjectTokenFile` or the response of
+	// `SubjectTokenURL` is parsed as a JSON object, and the subject token is
+	// read from this field.
+	SubjectTokenFieldName string
+
+	// The Security Token Service endpoint. If empty, it defaults to
+	// `https://sts.googleapis.com/v1/token`.
+	STSEndpoint string
+
+	// A service account email to impersonate. If empty, the token returned by
+	// the Security Token Service is used as is.
+	ServiceAccount string
+}
+
+func externalAccountConfigFromGitConfig(ctx context.Context, g GitConfigAccessor, ea *ExternalAccountConfig) error {
+	var err error
+	for _, kv := range []struct {
+		key string
+		v   *string
+	}{
+		{"google.externalAccountAudience", &ea.Audience},
+		{"google.subjectTokenType", &ea.SubjectTokenType},
+		{"google.subjectTokenURL", &ea.SubjectTokenURL},
+		{"google.subjectTokenExecutable", &ea.SubjectTokenExecutable},
+		{"google.subjectTokenFieldName", &ea.SubjectTokenFieldName},
+		{"google.stsEndpoint", &ea.STSEndpoint},
+		{"google.externalAccountServiceAccount", &ea.ServiceAccount},
+	} {
+		*kv.v, err = g.StringConfig(ctx, kv.key)
+		if err != nil {
+			return xerrors.Errorf("credentials: cannot get %s config: %w", kv.key, err)
+		}
+	}
+	ea.SubjectTokenFile, err = g.PathConfig(ctx, "google.subjectTokenFile")
+	if err != nil {
+		return xerrors.Errorf("credentials: cannot get the subject token file path: %w", err)
+	}
+	ea.SubjectTokenURLHeaders, err = g.StringListConfig(ctx, "google.subjectTokenURLHeaders")
+	if err != nil {
+		return xerrors.Errorf("credentials: cannot get a list of subject token URL headers: %w", err)
+	}
+	return nil
+}
+
+func newExternalAccountTokenSource(ctx context.Context, c *CredentialConfig, scopes []string) (oauth2.TokenSource, error) {
+	ea := c.ExternalAccount
+	if ea.ServiceAccount == "" {
+		return newSTSTokenSource(ctx, ea, scopes, c.MinTokenLifetime)
+	}
+	// The federated token is used only for calling IAM.
+	ts, err := newSTSTokenSource(ctx, ea, []string{scopeCloudPlatform}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return newIAMCredentialsTokenSource(ctx, ts, ea.ServiceAccount, c.ServiceAccountDelegateEmails, scopes, c)
+}
+
+// newSTSTokenSource returns a TokenSource that returns the federated access
+// tokens valid for at least minLifetime if possible.
+func newSTSTokenSource(ctx context.Context, ea ExternalAccountConfig, scopes []string, minLifetime time.Duration) (oauth2.TokenSource, error) {
+	if ea.Audience == "" {
+		return nil, xerrors.New("credentials: google.externalAccountAudience is required for external-account")
+	}
+	n := 0
+	for _, s := range []string{ea.SubjectTokenFile, ea.SubjectTokenURL, ea.SubjectTokenExecutable} {
+		if s != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, xerrors.New("credentials: exactly one of google.subjectTokenFile, google.subjectTokenURL and google.subjectTokenExecutable must be specified for external-account")
+	}
+	if ea.SubjectTokenType == "" {
+		ea.SubjectTokenType = defaultSubjectTokenType
+	}
+	if ea.STSEndpoint == "" {
+		ea.STSEndpoint = defaultSTSEndpoint
+	}
+	var executable []string
+	if ea.SubjectTokenExecutable != "" {
+		var err error
+		executable, err = splitCommand(ea.SubjectTokenExecutable)
+		if err != nil {
+			return nil, xerrors.Errorf("credentials: cannot parse google.subjectTokenExecutable %q: %w", ea.SubjectTokenExecutable, err)
+		}
+		if len(executable) == 0 {
+			return nil, xerrors.New("credentials: google.subjectTokenExecutable has no command")
+		}
+	}
+	return newMinLifetimeTokenSource(&externalAccountTokenSource{
+		ctx:        ctx,
+		config:     ea,
+		scopes:     scopes,
+		executable: executable,
+	}, minLifetime), nil
+}
+
+// externalAccountTokenSource exchanges a subject token to a federated access
+// token at the Security Token Service.
+type externalAccountTokenSource struct {
+	ctx    context.Context
+	config ExternalAccountConfig
+	scopes []string
+	// executable is SubjectTokenExecutable split into the arguments.
+	executable []string
+}
+
+type stsResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (s *externalAccountTokenSource) Token() (*oauth2.Token, error) {
+	subjectToken, err := s.subjectToken()
+	if err != nil {
+		return nil, err
+	}
+	var token *oauth2.Token
+	err = retryTransient(s.ctx, func() error {
+		var err error
+		token, err = s.exchange(subjectToken)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// exchange exchanges the subject token at the Security Token Service.
+func (s *externalAccountTokenSource) exchange(subjectToken string) (*oauth2.Token, error) {
+	v := url.Values{}
+	v.Set("grant_type", grantTypeTokenExchange)
+	v.Set("audience", s.config.Audience)
+	v.Set("scope", strings.Join(s.scopes, " "))
+	v.Set("requested_token_type", requestedTokenTypeAccess)
+	v.Set("subject_token", subjectToken)
+	v.Set("subject_token_type", s.config.SubjectTokenType)
+	req, err := http.NewRequest("POST", s.config.STSEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot create an STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.httpClient().Do(req.WithContext(s.ctx))
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot exchange the subject token: %w", newAPIError("Security Token Service", err))
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot read the STS response: %w", newAPIError("Security Token Service", err))
+	}
+
+	sr := &stsResponse{}
+	if resp.StatusCode != http.StatusOK {
+		// The error response is not always JSON, e.g. an HTML page from a
+		// proxy for HTTP 502.
+		message := strings.TrimSpace(string(bs))
+		if err := json.Unmarshal(bs, sr); err == nil && sr.Error != "" {
+			message = sr.Error + ": " + sr.ErrorDescription
+		}
+		return nil, xerrors.Errorf("credentials: cannot exchange the subject token: %w", newHTTPAPIError("Security Token Service", resp.StatusCode, message))
+	}
+	if err := json.Unmarshal(bs, sr); err != nil {
+		return nil, xerrors.Errorf("credentials: cannot parse the STS response: %w", err)
+	}
+	if sr.AccessToken == "" {
+		return nil, xerrors.New("credentials: STS returned no access token")
+	}
+	// A token without an expiry would be reused forever.
+	if sr.ExpiresIn <= 0 {
+		return nil, xerrors.Errorf("credentials: STS returned an invalid expires_in %d", sr.ExpiresIn)
+	}
+	return &oauth2.Token{
+		AccessToken: sr.AccessToken,
+		TokenType:   sr.TokenType,
+		Expiry:      time.Now().Add(time.Duration(sr.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// httpClient returns the HTTP client in the context as oauth2.HTTPClient, or
+// the default client.
+func (s *externalAccountTokenSource) httpClient() *http.Client {
+	if c, ok := s.ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c
+	}
+	return http.DefaultClient
+}
+
+func (s *externalAccountTokenSource) subjectToken() (string, error) {
+	switch {
+	case s.config.SubjectTokenFile != "":
+		bs, err := ioutil.ReadFile(s.config.SubjectTokenFile)
+		if err != nil {
+			return "", xerrors.Errorf("credentials: cannot read the subject token file: %w", err)
+		}
+		return s.parseSubjectToken(bs)
+
+	case s.config.SubjectTokenURL != "":
+		req, err := http.NewRequest("GET", os.ExpandEnv(s.config.SubjectTokenURL), nil)
+		if err != nil {
+			return "", xerrors.Errorf("credentials: cannot create a subject token request: %w", err)
+		}
+		for _, h := range s.config.SubjectTokenURLHeaders {
+			ss := strings.SplitN(h, ":", 2)
+			if len(ss) != 2 {
+				return "", xerrors.Errorf("credentials: malformed subject token URL header: %q", h)
+			}
+			req.Header.Set(strings.TrimSpace(ss[0]), os.ExpandEnv(strings.TrimSpace(ss[1])))
+		}
+		resp, err := s.httpClient().Do(req.WithContext(s.ctx))
+		if err != nil {
+			return "", xerrors.Errorf("credentials: cannot get the subject token: %w", err)
+		}
+		defer resp.Body.Close()
+		bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		if err != nil {
+			return "", xerrors.Errorf("credentials: cannot read the subject token: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", xerrors.Errorf("credentials: cannot get the subject token (HTTP %d): %s", resp.StatusCode, bs)
+		}
+		return s.parseSubjectToken(bs)
+
+	default:
+		return s.executableSubjectToken()
+	}
+}
+
+func (s *externalAccountTokenSource) parseSubjectToken(bs []byte) (string, error) {
+	if s.config.SubjectTokenFieldName == "" {
+		return strings.TrimSpace(string(bs)), nil
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return "", xerrors.Errorf("credentials: cannot parse the subject token as JSON: %w", err)
+	}
+	token, ok := m[s.config.SubjectTokenFieldName].(string)
+	if !ok || token == "" {
+		return "", xerrors.Errorf("credentials: the subject token JSON has no %q field", s.config.SubjectTokenFieldName)
+	}
+	return token, nil
+}
+
+// executableResponse is the executable-sourced credentials output format.
+type executableResponse struct {
+	Version        int    `json:"version"`
+	Success        *bool  `json:"success"`
+	TokenType      string `json:"token_type"`
+	IDToken        string `json:"id_token"`
+	SAMLResponse   string `json:"saml_response"`
+	ExpirationTime int64  `json:"expiration_time"`
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+}
+
+func (s *externalAccountTokenSource) executableSubjectToken() (string, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, subjectTokenExecTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.executable[0], s.executable[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GOOGLE_EXTERNAL_ACCOUNT_AUDIENCE="+s.config.Audience,
+		"GOOGLE_EXTERNAL_ACCOUNT_TOKEN_TYPE="+s.config.SubjectTokenType,
+		"GOOGLE_EXTERNAL_ACCOUNT_INTERACTIVE=0",
+	)
+	if s.config.ServiceAccount != "" {
+		cmd.Env = append(cmd.Env, "GOOGLE_EXTERNAL_ACCOUNT_IMPERSONATED_EMAIL="+s.config.ServiceAccount)
+	}
+	bs, err := runCommand(cmd)
+	if err != nil {
+		return "", xerrors.Errorf("credentials: failed to run the subject token executable: %w", contextError(ctx, err))
+	}
+
+	bs = []byte(strings.TrimSpace(string(bs)))
+	if !strings.HasPrefix(string(bs), "{") {
+		return string(bs), nil
+	}
+	er := &executableResponse{}
+	if err := json.Unmarshal(bs, er); err != nil {
+		return "", xerrors.Errorf("credentials: cannot parse the subject token executable output: %w", err)
+	}
+	if er.Success != nil && !*er.Success {
+		return "", xerrors.Errorf("credentials: the subject token executable failed: %s: %s", er.Code, er.Message)
+	}
+	if er.ExpirationTime != 0 && time.Unix(er.ExpirationTime, 0).Before(time.Now()) {
+		return "", xerrors.New("credentials: the subject token executable returned an expired token")
+	}
+	if er.IDToken != "" {
+		return er.IDToken, nil
+	}
+	if er.SAMLResponse != "" {
+		return er.SAMLResponse, nil
+	}
+	return "", xerrors.New("credentials: the subject token executable returned no token")
+}
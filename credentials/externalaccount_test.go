@@ -0,0 +1,312 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+const testAudience = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider"
+
+// newFakeSTS returns a fake Security Token Service that accepts only
+// wantSubjectToken.
+func newFakeSTS(t *testing.T, wantSubjectToken string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm: %v", err)
+		}
+		for k, want := range map[string]string{
+			"grant_type":           grantTypeTokenExchange,
+			"audience":             testAudience,
+			"scope":                scopeCloudPlatform,
+			"requested_token_type": requestedTokenTypeAccess,
+			"subject_token_type":   defaultSubjectTokenType,
+		} {
+			if got := r.PostForm.Get(k); got != want {
+				t.Errorf("STS request %s = %q, want %q", k, got, want)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("subject_token") != wantSubjectToken {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&stsResponse{
+				Error:            "invalid_grant",
+				ErrorDescription: "bad subject token",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(&stsResponse{
+			AccessToken: "federated-token",
+			TokenType:   "Bearer",
+			ExpiresIn:   3600,
+		})
+	}))
+}
+
+func TestExternalAccountTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "externalaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sts := newFakeSTS(t, "subject-token")
+	defer sts.Close()
+
+	subjectTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer request-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"value": "subject-token"}`))
+	}))
+	defer subjectTokenServer.Close()
+
+	plainFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(plainFile, []byte("subject-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := filepath.Join(dir, "token.json")
+	if err := ioutil.WriteFile(jsonFile, []byte(`{"access_token": "subject-token"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wrongFile := filepath.Join(dir, "wrong")
+	if err := ioutil.WriteFile(wrongFile, []byte("wrong-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("TEST_REQUEST_TOKEN", "request-token")
+	defer os.Unsetenv("TEST_REQUEST_TOKEN")
+
+	for _, tc := range []struct {
+		name    string
+		config  ExternalAccountConfig
+		wantErr bool
+	}{
+		{
+			name:   "file",
+			config: ExternalAccountConfig{SubjectTokenFile: plainFile},
+		},
+		{
+			name: "json file",
+			config: ExternalAccountConfig{
+				SubjectTokenFile:      jsonFile,
+				SubjectTokenFieldName: "access_token",
+			},
+		},
+		{
+			name: "url",
+			config: ExternalAccountConfig{
+				SubjectTokenURL:        subjectTokenServer.URL,
+				SubjectTokenURLHeaders: []string{"Authorization: Bearer ${TEST_REQUEST_TOKEN}"},
+				SubjectTokenFieldName:  "value",
+			},
+		},
+		{
+			name:    "rejected",
+			config:  ExternalAccountConfig{SubjectTokenFile: wrongFile},
+			wantErr: true,
+		},
+		{
+			name: "multiple sources",
+			config: ExternalAccountConfig{
+				SubjectTokenFile: plainFile,
+				SubjectTokenURL:  subjectTokenServer.URL,
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Audience = testAudience
+			tc.config.STSEndpoint = sts.URL
+			c := &CredentialConfig{
+				Account:         accountExternalAccount,
+				ExternalAccount: tc.config,
+			}
+			ts, err := TokenSourceFromConfig(context.Background(), c)
+			if err == nil {
+				var token *oauth2.Token
+				token, err = ts.Token()
+				if err == nil {
+					if token.AccessToken != "federated-token" {
+						t.Errorf("got %q, want federated-token", token.AccessToken)
+					}
+					if d := time.Until(token.Expiry); d < 59*time.Minute || d > time.Hour {
+						t.Errorf("unexpected expiry %v", token.Expiry)
+					}
+				}
+			}
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestExternalAccountExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	dir, err := ioutil.TempDir("", "externalaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sts := newFakeSTS(t, "subject-token")
+	defer sts.Close()
+
+	script := filepath.Join(dir, "subject token executable")
+	if err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+test "$GOOGLE_EXTERNAL_ACCOUNT_AUDIENCE" = "$1" || exit 1
+echo '{"version": 1, "success": true, "token_type": "urn:ietf:params:oauth:token-type:jwt", "id_token": "subject-token"}'
+`), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+		Account: accountExternalAccount,
+		ExternalAccount: ExternalAccountConfig{
+			Audience:               testAudience,
+			SubjectTokenExecutable: "  ",
+			STSEndpoint:            sts.URL,
+		},
+	}); err == nil {
+		t.Error("TokenSourceFromConfig succeeded with a blank executable, want an error")
+	}
+
+	ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+		Account: accountExternalAccount,
+		ExternalAccount: ExternalAccountConfig{
+			Audience:               testAudience,
+			SubjectTokenExecutable: "'" + script + "' \"" + testAudience + "\"",
+			STSEndpoint:            sts.URL,
+		},
+	})
+	if err != nil {
+		t.Fatalf("TokenSourceFromConfig: %v", err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "federated-token" {
+		t.Errorf("got %q, want federated-token", token.AccessToken)
+	}
+}
+
+func TestExternalAccountSTSErrors(t *testing.T) {
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "externalaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("subject-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var responses []func(w http.ResponseWriter)
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond := responses[0]
+		responses = responses[1:]
+		respond(w)
+	}))
+	defer sts.Close()
+	badGateway := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html>502 Bad Gateway</html>"))
+	}
+	respond := func(sr *stsResponse) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			json.NewEncoder(w).Encode(sr)
+		}
+	}
+	stsURL, err := url.Parse(sts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The requests are sent to the fake server only via the HTTP client in
+	// the context.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: rewriteTransport{stsURL}})
+
+	for _, tc := range []struct {
+		name          string
+		responses     []func(w http.ResponseWriter)
+		wantErr       bool
+		wantTransient bool
+	}{
+		{
+			name:      "retried",
+			responses: []func(w http.ResponseWriter){badGateway, respond(&stsResponse{AccessToken: "federated-token", ExpiresIn: 3600})},
+		},
+		{
+			name:          "persistent 502",
+			responses:     []func(w http.ResponseWriter){badGateway, badGateway, badGateway, badGateway},
+			wantErr:       true,
+			wantTransient: true,
+		},
+		{
+			name:      "no expiry",
+			responses: []func(w http.ResponseWriter){respond(&stsResponse{AccessToken: "federated-token"})},
+			wantErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			responses = tc.responses
+			ts, err := TokenSourceFromConfig(ctx, &CredentialConfig{
+				Account: accountExternalAccount,
+				ExternalAccount: ExternalAccountConfig{
+					Audience:         testAudience,
+					SubjectTokenFile: tokenFile,
+					STSEndpoint:      "https://sts.example.com/v1/token",
+				},
+			})
+			if err != nil {
+				t.Fatalf("TokenSourceFromConfig: %v", err)
+			}
+			token, err := ts.Token()
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if err == nil && token.AccessToken != "federated-token" {
+				t.Errorf("got %q, want federated-token", token.AccessToken)
+			}
+			if got := xerrors.Is(err, ErrTransient); got != tc.wantTransient {
+				t.Errorf("got transient %v, want %v: %v", got, tc.wantTransient, err)
+			}
+			if len(responses) != 0 {
+				t.Errorf("%d responses are not used", len(responses))
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+// fallbackTokenSource tries the accounts in order, and returns the token of
+// the first account that yields one. The account that succeeded is tried
+// first next time. If statePath is not empty, it's remembered in the file
+// so that the other processes skip the accounts that failed.
+type fallbackTokenSource struct {
+	ctx       context.Context
+	accounts  []Account
+	newSource func(account Account) (oauth2.TokenSource, error)
+	statePath string
+
+	mu      sync.Mutex
+	sources map[Account]oauth2.TokenSource
+	last    Account
+}
+
+func newFallbackTokenSource(ctx context.Context, accounts []Account, statePath string, newSource func(Account) (oauth2.TokenSource, error)) *fallbackTokenSource {
+	return &fallbackTokenSource{
+		ctx:       ctx,
+		accounts:  accounts,
+		newSource: newSource,
+		statePath: statePath,
+		sources:   map[Account]oauth2.TokenSource{},
+	}
+}
+
+func (s *fallbackTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.last
+	if last == (Account{}) && s.statePath != "" {
+		if bs, err := ioutil.ReadFile(s.statePath); err == nil {
+			last, _ = ParseAccount(strings.TrimSpace(string(bs)))
+		}
+	}
+	order := []Account{}
+	for _, a := range s.accounts {
+		if a == last {
+			order = append([]Account{a}, order...)
+		} else {
+			order = append(order, a)
+		}
+	}
+
+	var errs []string
+	var lastErr error
+	for _, account := range order {
+		token, err := s.token(account)
+		if err == nil {
+			if account != last {
+				s.writeState(account)
+			}
+			s.last = account
+			return token, nil
+		}
+		if s.ctx.Err() != nil {
+			return nil, contextError(s.ctx, err)
+		}
+		errs = append(errs, account.String()+": "+err.Error())
+		lastErr = err
+	}
+	return nil, xerrors.Errorf("credentials: none of the accounts yields a token (%s): %w", strings.Join(errs, "; "), lastErr)
+}
+
+func (s *fallbackTokenSource) token(account Account) (*oauth2.Token, error) {
+	ts, ok := s.sources[account]
+	if !ok {
+		var err error
+		ts, err = s.newSource(account)
+		if err != nil {
+			return nil, err
+		}
+		s.sources[account] = ts
+	}
+	return ts.Token()
+}
+
+func (s *fallbackTokenSource) writeState(account Account) {
+	if s.statePath == "" {
+		return
+	}
+	// This is an optimization. Failing to write it doesn't matter.
+	if err := os.MkdirAll(filepath.Dir(s.statePath), 0700); err != nil {
+		return
+	}
+	ioutil.WriteFile(s.statePath, []byte(account.String()+"\n"), 0600)
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+type fakeAccounts struct {
+	working map[string]bool
+	tried   []string
+}
+
+func (f *fakeAccounts) newSource(account Account) (oauth2.TokenSource, error) {
+	if account.Kind == AccountKindKeyFile {
+		f.tried = append(f.tried, account.String())
+		return nil, xerrors.New("cannot create")
+	}
+	return fakeAccountTokenSource{f, account.String()}, nil
+}
+
+type fakeAccountTokenSource struct {
+	f       *fakeAccounts
+	account string
+}
+
+func (s fakeAccountTokenSource) Token() (*oauth2.Token, error) {
+	s.f.tried = append(s.f.tried, s.account)
+	if !s.f.working[s.account] {
+		return nil, xerrors.Errorf("%s: %w", s.account, ErrNotLoggedIn)
+	}
+	return &oauth2.Token{AccessToken: s.account}, nil
+}
+
+func TestFallbackTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.account")
+	accounts, err := ParseAccounts("keyfile:broken, gcloud, application-default, metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeAccounts{working: map[string]bool{"adc": true, "metadata": true}}
+	token, err := newFallbackTokenSource(context.Background(), accounts, statePath, f.newSource).Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "adc" {
+		t.Errorf("got %q, want adc", token.AccessToken)
+	}
+	if want := []string{"keyfile:broken", "gcloud", "adc"}; !reflect.DeepEqual(f.tried, want) {
+		t.Errorf("tried %q, want %q", f.tried, want)
+	}
+
+	// Another process starts from the account that succeeded.
+	f.tried = nil
+	if _, err := newFallbackTokenSource(context.Background(), accounts, statePath, f.newSource).Token(); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if want := []string{"adc"}; !reflect.DeepEqual(f.tried, want) {
+		t.Errorf("tried %q, want %q", f.tried, want)
+	}
+
+	// If it stops working, the others are tried in order.
+	f.tried = nil
+	f.working["adc"] = false
+	token, err = newFallbackTokenSource(context.Background(), accounts, statePath, f.newSource).Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "metadata" {
+		t.Errorf("got %q, want metadata", token.AccessToken)
+	}
+	if want := []string{"adc", "keyfile:broken", "gcloud", "metadata"}; !reflect.DeepEqual(f.tried, want) {
+		t.Errorf("tried %q, want %q", f.tried, want)
+	}
+
+	// All accounts fail.
+	f.working = nil
+	_, err = newFallbackTokenSource(context.Background(), accounts, "", f.newSource).Token()
+	if err == nil || !strings.Contains(err.Error(), "keyfile:broken: cannot create") || !xerrors.Is(err, ErrNotLoggedIn) {
+		t.Errorf("got %v, want an error of all accounts", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package credentials
+
+// fileLock is a no-op on the platforms without a file locking primitive. The
+// token cache still works, but concurrent processes may mint tokens
+// redundantly.
+type fileLock struct{}
+
+func tryLockFile(path string) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+func (l *fileLock) unlock() error {
+	return nil
+}
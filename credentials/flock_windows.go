@@ -0,0 +1,49 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+type fileLock struct {
+	f *os.File
+}
+
+// tryLockFile locks the file without blocking. It returns nil if the file is
+// locked by another process.
+func tryLockFile(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ol := new(windows.Overlapped)
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol); err != nil {
+		f.Close()
+		if err == windows.ERROR_LOCK_VIOLATION {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &fileLock{f}, nil
+}
+
+func (l *fileLock) unlock() error {
+	defer l.f.Close()
+	ol := new(windows.Overlapped)
+	return windows.UnlockFileEx(windows.Handle(l.f.Fd()), 0, 1, 0, ol)
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// assumedTokenLifetime is the lifetime assumed for an access token whose
+	// expiry is unknown. gcloud can return a cached token, so this is much
+	// shorter than the usual one hour.
+	assumedTokenLifetime = 5 * time.Minute
+)
+
+// tokenInfoURL is the endpoint to introspect access tokens.
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// gcloudOutput is the union of the JSON output formats of gcloud that hold an
+// access token.
+type gcloudOutput struct {
+	// `auth print-access-token` of oauth2client based gcloud.
+	AccessToken string          `json:"access_token"`
+	TokenExpiry json.RawMessage `json:"token_expiry"`
+	// `auth print-access-token` of google-auth based gcloud.
+	Token  string          `json:"token"`
+	Expiry json.RawMessage `json:"expiry"`
+	// `config config-helper`.
+	Credential *gcloudOutput `json:"credential"`
+}
+
+// parseGcloudOutput parses the output of `gcloud auth print-access-token` or
+// `gcloud config config-helper` in any of the formats known so far. The
+// expiry of the returned token is zero if the output doesn't have it.
+func parseGcloudOutput(bs []byte) (*oauth2.Token, error) {
+	bs = bytes.TrimSpace(bs)
+	if len(bs) == 0 {
+		return nil, xerrors.New("empty output")
+	}
+
+	switch bs[0] {
+	case '{':
+	case '"':
+		// `--format=json` of a bare token.
+		var s string
+		if err := json.Unmarshal(bs, &s); err != nil {
+			return nil, err
+		}
+		return bareGcloudToken(s)
+	default:
+		return bareGcloudToken(string(bs))
+	}
+
+	out := &gcloudOutput{}
+	if err := json.Unmarshal(bs, out); err != nil {
+		return nil, err
+	}
+	if out.Credential != nil {
+		out = out.Credential
+	}
+	token := &oauth2.Token{AccessToken: out.AccessToken}
+	expiry := out.TokenExpiry
+	if token.AccessToken == "" {
+		token.AccessToken = out.Token
+		expiry = out.Expiry
+	}
+	if token.AccessToken == "" {
+		return nil, xerrors.New("no access token in the output")
+	}
+	var err error
+	token.Expiry, err = parseGcloudExpiry(expiry)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse the expiry %s: %w", expiry, err)
+	}
+	return token, nil
+}
+
+func bareGcloudToken(s string) (*oauth2.Token, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.ContainsAny(s, " \t\r\n") {
+		return nil, xerrors.New("not a token")
+	}
+	return &oauth2.Token{AccessToken: s}, nil
+}
+
+// parseGcloudExpiry parses the expiry in an object with "datetime", a
+// timestamp string, or UNIX seconds. The timestamps without a timezone are in
+// UTC.
+func parseGcloudExpiry(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, nil
+	}
+	var obj struct {
+		DateTime string `json:"datetime"`
+	}
+	var s string
+	var sec float64
+	switch {
+	case json.Unmarshal(raw, &obj) == nil:
+		s = obj.DateTime
+	case json.Unmarshal(raw, &s) == nil:
+	case json.Unmarshal(raw, &sec) == nil:
+		return time.Unix(int64(sec), 0), nil
+	default:
+		return time.Time{}, xerrors.New("unknown format")
+	}
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		// The fraction of seconds is accepted even if the layout doesn't
+		// have it.
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, xerrors.Errorf("unknown timestamp %q", s)
+}
+
+// accessTokenExpiry returns the expiry of the access token. The token is
+// decoded if it's a JWT, or else introspected at the tokeninfo endpoint. If
+// both fail, it returns a conservative expiry.
+func accessTokenExpiry(ctx context.Context, accessToken string) time.Time {
+	if strings.Count(accessToken, ".") == 2 {
+		if claims, err := jws.Decode(accessToken); err == nil && claims.Exp > 0 {
+			return time.Unix(claims.Exp, 0)
+		}
+	}
+	if t, err := tokenInfoExpiry(ctx, accessToken); err == nil {
+		return t
+	}
+	return time.Now().Add(assumedTokenLifetime)
+}
+
+func tokenInfoExpiry(ctx context.Context, accessToken string) (time.Time, error) {
+	start := time.Now()
+	req, err := http.NewRequest("POST", tokenInfoURL, strings.NewReader(url.Values{"access_token": {accessToken}}.Encode()))
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := http.DefaultClient
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = c
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, newHTTPAPIError("OAuth2 tokeninfo", resp.StatusCode, strings.TrimSpace(string(bs)))
+	}
+	// The numbers are returned as strings.
+	info := struct {
+		ExpiresIn json.RawMessage `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(bs, &info); err != nil {
+		return time.Time{}, err
+	}
+	n, err := strconv.ParseInt(strings.Trim(string(info.ExpiresIn), `"`), 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}, xerrors.Errorf("invalid expires_in %s", info.ExpiresIn)
+	}
+	return start.Add(time.Duration(n) * time.Second), nil
+}
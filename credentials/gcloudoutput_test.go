@@ -0,0 +1,200 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// The files in testdata/gcloud-output are the outputs recorded from the
+// gcloud releases.
+func TestParseGcloudOutput(t *testing.T) {
+	for _, tc := range []struct {
+		file       string
+		wantToken  string
+		wantExpiry string
+		wantErr    bool
+	}{
+		{file: "oauth2client.json", wantToken: "ya29.oauth2client", wantExpiry: "2020-05-01T12:34:56.789012Z"},
+		{file: "token-expiry-string.json", wantToken: "ya29.token-expiry-string", wantExpiry: "2021-02-03T04:05:06Z"},
+		{file: "google-auth.json", wantToken: "ya29.google-auth", wantExpiry: "2023-03-04T05:06:07.123456Z"},
+		{file: "google-auth-naive.json", wantToken: "ya29.google-auth-naive", wantExpiry: "2023-03-04T05:06:07.123456Z"},
+		{file: "no-expiry.json", wantToken: "ya29.no-expiry"},
+		{file: "json-string.json", wantToken: "ya29.json-string"},
+		{file: "bare.txt", wantToken: "ya29.bare"},
+		{file: "config-helper.json", wantToken: "ya29.config-helper", wantExpiry: "2022-06-07T08:09:10Z"},
+		{file: "warning.txt", wantErr: true},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			bs, err := ioutil.ReadFile(filepath.Join("testdata", "gcloud-output", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := parseGcloudOutput(bs)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseGcloudOutput: %v", err)
+			}
+			if token.AccessToken != tc.wantToken {
+				t.Errorf("got token %q, want %q", token.AccessToken, tc.wantToken)
+			}
+			gotExpiry := ""
+			if !token.Expiry.IsZero() {
+				gotExpiry = token.Expiry.UTC().Format(time.RFC3339Nano)
+			}
+			if gotExpiry != tc.wantExpiry {
+				t.Errorf("got expiry %q, want %q", gotExpiry, tc.wantExpiry)
+			}
+		})
+	}
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("access_token") != "ya29.known" {
+			http.Error(w, `{"error": "invalid_token"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"azp": "client", "expires_in": "1800", "scope": "openid"}`)
+	}))
+	defer srv.Close()
+	defer func(u string) { tokenInfoURL = u }(tokenInfoURL)
+	tokenInfoURL = srv.URL
+
+	enc := base64.RawURLEncoding
+	jwt := enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + enc.EncodeToString([]byte(`{"exp":4102444800}`)) + "." + enc.EncodeToString([]byte("sig"))
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  time.Time
+	}{
+		{"JWT", jwt, time.Unix(4102444800, 0)},
+		{"tokeninfo", "ya29.known", now.Add(30 * time.Minute)},
+		{"unknown", "ya29.unknown", now.Add(assumedTokenLifetime)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := accessTokenExpiry(context.Background(), tc.token)
+			if d := got.Sub(tc.want); d < -time.Minute || d > time.Minute {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGcloudConfigHelperFallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	dir, err := ioutil.TempDir("", "gcloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	helperOutput, err := filepath.Abs(filepath.Join("testdata", "gcloud-output", "config-helper.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A gcloud that prints an unknown format for print-access-token.
+	gcloud := filepath.Join(dir, "gcloud")
+	script := `#!/bin/sh
+case "$*" in
+*print-access-token*) echo "Your access token is ya29.unknown-format" ;;
+*"config config-helper --account=user@example.com"*) cat ` + helperOutput + ` ;;
+*) exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(gcloud, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+		Account:    "user@example.com",
+		GcloudPath: gcloud,
+	})
+	if err != nil {
+		t.Fatalf("TokenSourceFromConfig: %v", err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "ya29.config-helper" {
+		t.Errorf("got %q, want the token from config-helper", token.AccessToken)
+	}
+}
+
+func TestGcloudForceRefresh(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	dir, err := ioutil.TempDir("", "gcloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A gcloud that returns its cached token that expires soon unless a
+	// refresh is forced.
+	gcloud := filepath.Join(dir, "gcloud")
+	script := `#!/bin/sh
+case "$*" in
+*print-access-token*) echo '{"token": "cached", "expiry": "2000-01-01T00:00:00Z"}' ;;
+*"config-helper --force-auth-refresh"*) echo '{"credential": {"access_token": "refreshed", "token_expiry": "2099-01-01T00:00:00Z"}}' ;;
+*) exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(gcloud, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		minLifetime time.Duration
+		want        string
+	}{
+		{0, "cached"},
+		{10 * time.Minute, "refreshed"},
+	} {
+		ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+			GcloudPath:       gcloud,
+			MinTokenLifetime: tc.minLifetime,
+		})
+		if err != nil {
+			t.Fatalf("TokenSourceFromConfig: %v", err)
+		}
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if token.AccessToken != tc.want {
+			t.Errorf("minLifetime %v: got %q, want %q", tc.minLifetime, token.AccessToken, tc.want)
+		}
+	}
+}
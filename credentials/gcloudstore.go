@@ -0,0 +1,304 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/xerrors"
+)
+
+const (
+	gcloudCredentialsDB  = "credentials.db"
+	gcloudAccessTokensDB = "access_tokens.db"
+
+	defaultGcloudConfiguration = "default"
+)
+
+// gcloudStoredCredential is the subset of an authorized user credential stored
+// in gcloud's credentials.db.
+type gcloudStoredCredential struct {
+	Type         string `json:"type"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// gcloudStoreTokenSource reads the credentials of a gcloud account from
+// gcloud's credential store, and refreshes the access token in-process. This
+// avoids starting gcloud, which takes a second or two.
+//
+// The store is an internal format of gcloud. If it cannot be read for any
+// reason, the token is obtained with the fallback TokenSource, which runs
+// gcloud.
+type gcloudStoreTokenSource struct {
+	ctx           context.Context
+	name          string
+	configDir     string
+	configuration string
+	// The cached access token is not used if it expires sooner than this.
+	minLifetime time.Duration
+	// fallback is nil if gcloud is not available. fallbackErr tells why.
+	fallback    oauth2.TokenSource
+	fallbackErr error
+}
+
+func (s *gcloudStoreTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.storeToken()
+	if err == nil {
+		return token, nil
+	}
+	if s.ctx.Err() != nil {
+		return nil, contextError(s.ctx, err)
+	}
+	if s.fallback == nil {
+		return nil, xerrors.Errorf("credentials: cannot use the gcloud credential store (%v), and cannot run gcloud: %w", err, s.fallbackErr)
+	}
+	return s.fallback.Token()
+}
+
+func (s *gcloudStoreTokenSource) storeToken() (*oauth2.Token, error) {
+	dir := s.configDir
+	if dir == "" {
+		var err error
+		dir, err = defaultGcloudConfigDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	account := s.name
+	if account == "" {
+		var err error
+		account, err = gcloudActiveAccount(dir, s.configuration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cached, err := readGcloudAccessToken(filepath.Join(dir, gcloudAccessTokensDB), account)
+	if err != nil {
+		// The access token cache is optional.
+		cached = &gcloudAccessToken{}
+	}
+	if cachedTokenValid(&cached.Token, time.Now(), s.minLifetime) {
+		return &cached.Token, nil
+	}
+
+	rows, err := readSQLiteTable(filepath.Join(dir, gcloudCredentialsDB), "credentials")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if r["account_id"] != account {
+			continue
+		}
+		var value []byte
+		switch v := r["value"].(type) {
+		case string:
+			value = []byte(v)
+		case []byte:
+			value = v
+		}
+		cred := &gcloudStoredCredential{}
+		if err := json.Unmarshal(value, cred); err != nil {
+			return nil, xerrors.Errorf("credentials: cannot parse the stored credential of %s: %w", account, err)
+		}
+		if cred.Type != "authorized_user" || cred.RefreshToken == "" {
+			return nil, xerrors.Errorf("credentials: unsupported stored credential type %q of %s", cred.Type, account)
+		}
+		// The access token cache keeps the reauth proof token for the
+		// accounts that require reauthentication.
+		return refreshGcloudCredential(s.ctx, cred, cached.raptToken)
+	}
+	return nil, xerrors.Errorf("credentials: %s is not in the gcloud credential store", account)
+}
+
+type gcloudAccessToken struct {
+	oauth2.Token
+	raptToken string
+}
+
+// readGcloudAccessToken reads the access token cache of gcloud.
+func readGcloudAccessToken(path, account string) (*gcloudAccessToken, error) {
+	rows, err := readSQLiteTable(path, "access_tokens")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if r["account_id"] != account {
+			continue
+		}
+		token := &gcloudAccessToken{}
+		token.AccessToken, _ = r["access_token"].(string)
+		token.raptToken, _ = r["rapt_token"].(string)
+		if expiry, ok := r["token_expiry"].(string); ok {
+			// Python's datetime is stored in ISO 8601 format in UTC. The
+			// fraction of seconds is omitted if it's zero.
+			for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+				if t, err := time.Parse(layout, expiry); err == nil {
+					token.Expiry = t
+					break
+				}
+			}
+		}
+		return token, nil
+	}
+	return nil, xerrors.Errorf("credentials: no access token of %s", account)
+}
+
+type gcloudRefreshResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// refreshGcloudCredential obtains an access token with the refresh token.
+// Unlike oauth2.Config, this sends the reauth proof token as gcloud does.
+func refreshGcloudCredential(ctx context.Context, cred *gcloudStoredCredential, rapt string) (*oauth2.Token, error) {
+	tokenURI := cred.TokenURI
+	if tokenURI == "" {
+		tokenURI = google.Endpoint.TokenURL
+	}
+	v := url.Values{}
+	v.Set("grant_type", "refresh_token")
+	v.Set("client_id", cred.ClientID)
+	v.Set("client_secret", cred.ClientSecret)
+	v.Set("refresh_token", cred.RefreshToken)
+	if rapt != "" {
+		v.Set("rapt", rapt)
+	}
+	req, err := http.NewRequest("POST", tokenURI, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot create a token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := http.DefaultClient
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = c
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot refresh the gcloud credential: %w", newAPIError("OAuth2 token endpoint", err))
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot read the token response: %w", err)
+	}
+	tr := &gcloudRefreshResponse{}
+	jsonErr := json.Unmarshal(bs, tr)
+	if resp.StatusCode != http.StatusOK {
+		ae := newHTTPAPIError("OAuth2 token endpoint", resp.StatusCode, strings.TrimSpace(string(bs))).(*APIError)
+		switch {
+		case strings.Contains(tr.ErrorDescription, "rapt") || tr.Error == "invalid_rapt":
+			ae.Class = ErrReauthRequired
+		case tr.Error == "invalid_grant":
+			ae.Class = ErrNotLoggedIn
+		}
+		return nil, xerrors.Errorf("credentials: cannot refresh the gcloud credential: %w", ae)
+	}
+	if jsonErr != nil {
+		return nil, xerrors.Errorf("credentials: cannot parse the token response: %w", jsonErr)
+	}
+	if tr.AccessToken == "" {
+		return nil, xerrors.New("credentials: the token endpoint returned no access token")
+	}
+	return &oauth2.Token{
+		AccessToken: tr.AccessToken,
+		TokenType:   tr.TokenType,
+		Expiry:      time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// defaultGcloudConfigDir returns the gcloud config directory used when
+// google.gcloudConfigDir is not specified.
+func defaultGcloudConfigDir() (string, error) {
+	if d := os.Getenv("CLOUDSDK_CONFIG"); d != "" {
+		return d, nil
+	}
+	if runtime.GOOS == "windows" {
+		if d := os.Getenv("APPDATA"); d != "" {
+			return filepath.Join(d, "gcloud"), nil
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", xerrors.Errorf("credentials: cannot find the gcloud config directory: %w", err)
+	}
+	return filepath.Join(home, ".config", "gcloud"), nil
+}
+
+// gcloudActiveAccount returns the account of the gcloud configuration. If
+// configuration is empty, the active configuration is used.
+func gcloudActiveAccount(dir, configuration string) (string, error) {
+	if a := os.Getenv("CLOUDSDK_CORE_ACCOUNT"); a != "" {
+		return a, nil
+	}
+	if configuration == "" {
+		configuration = os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	}
+	if configuration == "" {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "active_config"))
+		if err != nil && !os.IsNotExist(err) {
+			return "", xerrors.Errorf("credentials: cannot read the active gcloud configuration: %w", err)
+		}
+		configuration = strings.TrimSpace(string(bs))
+	}
+	if configuration == "" {
+		configuration = defaultGcloudConfiguration
+	}
+
+	f, err := os.Open(filepath.Join(dir, "configurations", "config_"+configuration))
+	if err != nil {
+		return "", xerrors.Errorf("credentials: cannot read the gcloud configuration %s: %w", configuration, err)
+	}
+	defer f.Close()
+	section := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == "core" && strings.Contains(line, "="):
+			kv := strings.SplitN(line, "=", 2)
+			if strings.TrimSpace(kv[0]) == "account" {
+				if a := strings.TrimSpace(kv[1]); a != "" {
+					return a, nil
+				}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", xerrors.Errorf("credentials: cannot read the gcloud configuration %s: %w", configuration, err)
+	}
+	return "", xerrors.Errorf("credentials: no account in the gcloud configuration %s: %w", configuration, ErrNotLoggedIn)
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+// The fixture databases in testdata/gcloud are generated by generate.py in
+// the same schema as gcloud.
+
+func TestReadSQLiteTable(t *testing.T) {
+	rows, err := readSQLiteTable(filepath.Join("testdata", "gcloud", gcloudCredentialsDB), "credentials")
+	if err != nil {
+		t.Fatalf("readSQLiteTable: %v", err)
+	}
+	if len(rows) != 104 {
+		t.Errorf("got %d rows, want 104", len(rows))
+	}
+	found := false
+	for _, r := range rows {
+		if r["account_id"] != "long@example.com" {
+			continue
+		}
+		found = true
+		// The value spills to the overflow pages.
+		if v, _ := r["value"].(string); !strings.Contains(v, "refresh-"+strings.Repeat("x", 10000)+`"`) {
+			t.Errorf("long@example.com has a broken value of %d bytes", len(v))
+		}
+	}
+	if !found {
+		t.Error("long@example.com is not found")
+	}
+
+	if _, err := readSQLiteTable(filepath.Join("testdata", "gcloud", "active_config"), "credentials"); !strings.Contains(fmt.Sprint(err), errSQLiteUnsupported.Error()) {
+		t.Errorf("readSQLiteTable(non-database) = %v, want an unsupported error", err)
+	}
+}
+
+func TestReadSQLiteTableCorrupted(t *testing.T) {
+	bs, err := ioutil.ReadFile(filepath.Join("testdata", "gcloud", gcloudCredentialsDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A corrupted database is an error, not a panic.
+	for i := sqliteHeaderSize; i < len(bs); i += 61 {
+		corrupted := append([]byte(nil), bs...)
+		for j := i; j < i+9 && j < len(corrupted); j++ {
+			corrupted[j] = 0xff
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("panic with 0xff at %d: %v", i, r)
+				}
+			}()
+			if db, err := parseSQLiteDB(corrupted); err == nil {
+				db.readTable("credentials")
+			}
+		}()
+	}
+
+	// A payload size larger than the database.
+	db := &sqliteDB{data: make([]byte, 4096), pageSize: 4096, usable: 4096}
+	cell := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	if _, err := db.readLeafCell(cell); !xerrors.Is(err, errSQLiteUnsupported) {
+		t.Errorf("readLeafCell(huge payload) = %v, want an unsupported error", err)
+	}
+	// A serial type whose size doesn't fit in an int.
+	record := []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf1}
+	if _, err := parseSQLiteRecord(record); !xerrors.Is(err, errSQLiteUnsupported) {
+		t.Errorf("parseSQLiteRecord(huge serial type) = %v, want an unsupported error", err)
+	}
+	// A page number whose offset overflows.
+	if _, err := db.page(1 << 52); !xerrors.Is(err, errSQLiteUnsupported) {
+		t.Errorf("page(1 << 52) = %v, want an unsupported error", err)
+	}
+}
+
+// rewriteTransport sends all requests to the server.
+type rewriteTransport struct {
+	server *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = t.server.Scheme
+	req.URL.Host = t.server.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGcloudStoreTokenSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm: %v", err)
+		}
+		if r.URL.Path != "/token" || r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("client_id") != "client-id" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Form)
+		}
+		rt := r.Form.Get("refresh_token")
+		if len(rt) > 20 {
+			rt = fmt.Sprintf("%s(%d)", rt[:8], len(rt))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "refreshed %s %s", "expires_in": 3600, "token_type": "Bearer"}`, rt, r.Form.Get("rapt"))
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: rewriteTransport{srvURL}})
+
+	dir, err := ioutil.TempDir("", "gcloudstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gcloud := filepath.Join(dir, "gcloud")
+	script := `#!/bin/sh
+echo '{"access_token": "from-gcloud", "token_expiry": {"datetime": "2099-01-01 00:00:00.000000"}}'
+`
+	if err := ioutil.WriteFile(gcloud, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// A config directory in an unknown format.
+	broken := filepath.Join(dir, "broken")
+	if err := os.MkdirAll(filepath.Join(broken, "configurations"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		gcloudCredentialsDB:             "not a database",
+		"configurations/config_default": "[core]\naccount = cached@example.com\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(broken, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fixture, err := filepath.Abs(filepath.Join("testdata", "gcloud"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		account       string
+		configDir     string
+		configuration string
+		want          string
+	}{
+		{name: "cached token of the active configuration", configDir: fixture, want: "cached-access-token"},
+		{name: "refresh with rapt", configDir: fixture, configuration: "expired", want: "refreshed refresh-expired rapt-token"},
+		{name: "overflow pages", account: "long@example.com", configDir: fixture, want: "refreshed refresh-(10008) "},
+		{name: "unsupported credential type", account: "external@example.com", configDir: fixture, want: "from-gcloud"},
+		{name: "unknown account", account: "unknown@example.com", configDir: fixture, want: "from-gcloud"},
+		{name: "unknown format", configDir: broken, want: "from-gcloud"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts, err := TokenSourceFromConfig(ctx, &CredentialConfig{
+				Account:                  tc.account,
+				GcloudPath:               gcloud,
+				GcloudConfigDir:          tc.configDir,
+				GcloudConfiguration:      tc.configuration,
+				UseGcloudCredentialStore: true,
+			})
+			if err != nil {
+				t.Fatalf("TokenSourceFromConfig: %v", err)
+			}
+			token, err := ts.Token()
+			if err != nil {
+				t.Fatalf("Token: %v", err)
+			}
+			if token.AccessToken != tc.want {
+				t.Errorf("got %q, want %q", token.AccessToken, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+	"golang.org/x/xerrors"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	// TokenTypeAccessToken is the token type for OAuth2 access tokens.
+	TokenTypeAccessToken = "access_token"
+	// TokenTypeIDToken is the token type for OpenID Connect ID tokens.
+	TokenTypeIDToken = "id_token"
+)
+
+// newIDTokenSource returns a TokenSource that returns ID tokens for the
+// audience in the AccessToken field.
+func newIDTokenSource(ctx context.Context, c *CredentialConfig, account Account) (oauth2.TokenSource, error) {
+	switch account.Kind {
+	case AccountKindGcloud:
+		return newGcloudIDTokenSource(ctx, c, "", gcloudIDTokenAudience(c, ""))
+
+	case AccountKindUser:
+		return newGcloudIDTokenSource(ctx, c, account.Value, gcloudIDTokenAudience(c, account.Value))
+
+	case AccountKindApplicationDefault:
+		if c.Audience == "" {
+			return nil, xerrors.New("credentials: google.audience is required for ID tokens of the application default credentials")
+		}
+		return newRenewingTokenSource(func() (oauth2.TokenSource, error) {
+			ts, err := idtoken.NewTokenSource(ctx, c.Audience)
+			if err != nil {
+				return nil, xerrors.Errorf("credentials: cannot get ID tokens from the application default credentials: %w", err)
+			}
+			return ts, nil
+		}, c.MinTokenLifetime)
+
+	case AccountKindExternalAccount:
+		if c.ExternalAccount.ServiceAccount == "" {
+			return nil, xerrors.New("credentials: ID tokens for external-account require google.externalAccountServiceAccount")
+		}
+		ts, err := newSTSTokenSource(ctx, c.ExternalAccount, []string{scopeCloudPlatform}, 0)
+		if err != nil {
+			return nil, err
+		}
+		return newIAMIDTokenSource(ctx, ts, c.ExternalAccount.ServiceAccount, c.ServiceAccountDelegateEmails, c.Audience, c.MinTokenLifetime)
+
+	case AccountKindMetadata:
+		return newMetadataTokenSource(ctx, c, account.Value, nil), nil
+
+	case AccountKindKeyFile:
+		return newKeyFileTokenSource(ctx, c, account.Value, nil)
+
+	case AccountKindExec:
+		return newExecTokenSource(ctx, c, account.Value, nil)
+
+	case AccountKindServiceAccount:
+		ts, err := newImpersonationSource(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return newIAMIDTokenSource(ctx, ts, account.Value, c.ServiceAccountDelegateEmails, c.Audience, c.MinTokenLifetime)
+	}
+	return nil, xerrors.Errorf("credentials: unknown account kind %q", account.Kind)
+}
+
+// newIAMIDTokenSource returns a TokenSource that uses IAM Service Account
+// Credentials API to obtain ID tokens of the service account.
+func newIAMIDTokenSource(ctx context.Context, source oauth2.TokenSource, account string, delegates []string, audience string, minLifetime time.Duration) (oauth2.TokenSource, error) {
+	if audience == "" {
+		return nil, xerrors.New("credentials: google.audience is required for ID tokens of service accounts")
+	}
+	svc, err := newIAMCredentialsService(ctx, source)
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot create an IAM Service Account Credentials API client: %w", err)
+	}
+
+	ds := []string{}
+	for _, d := range delegates {
+		ds = append(ds, fmt.Sprintf("projects/-/serviceAccounts/%s", d))
+	}
+	return newMinLifetimeTokenSource(&iamIDTokenSource{
+		ctx:            ctx,
+		name:           fmt.Sprintf("projects/-/serviceAccounts/%s", account),
+		delegates:      ds,
+		audience:       audience,
+		iamCredService: iamcredentials.NewProjectsServiceAccountsService(svc),
+	}, minLifetime), nil
+}
+
+type iamIDTokenSource struct {
+	ctx            context.Context
+	name           string
+	delegates      []string
+	audience       string
+	iamCredService *iamcredentials.ProjectsServiceAccountsService
+}
+
+func (s *iamIDTokenSource) Token() (*oauth2.Token, error) {
+	var resp *iamcredentials.GenerateIdTokenResponse
+	err := retryTransient(s.ctx, func() error {
+		var err error
+		resp, err = s.iamCredService.GenerateIdToken(s.name, &iamcredentials.GenerateIdTokenRequest{
+			Audience:     s.audience,
+			Delegates:    s.delegates,
+			IncludeEmail: true,
+		}).Context(s.ctx).Do()
+		if err != nil {
+			return newAPIError("IAM Service Account Credentials API", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot obtain an ID token for %s: %w", s.name, err)
+	}
+	return idTokenToOAuth2Token(resp.Token)
+}
+
+// gcloudIDTokenAudience returns the audience to pass to gcloud for the
+// account, or the active gcloud account if empty. gcloud supports audiences
+// only for service accounts, and rejects them for Google Accounts. It returns
+// empty if the account is not a service account or cannot be found.
+func gcloudIDTokenAudience(c *CredentialConfig, account string) string {
+	if account == "" {
+		dir := c.GcloudConfigDir
+		if dir == "" {
+			var err error
+			if dir, err = defaultGcloudConfigDir(); err != nil {
+				return ""
+			}
+		}
+		var err error
+		if account, err = gcloudActiveAccount(dir, c.GcloudConfiguration); err != nil {
+			return ""
+		}
+	}
+	if !strings.HasSuffix(account, ".gserviceaccount.com") {
+		return ""
+	}
+	return c.Audience
+}
+
+func newGcloudIDTokenSource(ctx context.Context, c *CredentialConfig, name, audience string) (oauth2.TokenSource, error) {
+	gcloud, err := newGcloudCommand(c)
+	if err != nil {
+		return nil, err
+	}
+	return newMinLifetimeTokenSource(&gcloudIDTokenSource{
+		ctx:      ctx,
+		name:     name,
+		audience: audience,
+		gcloud:   gcloud,
+	}, c.MinTokenLifetime), nil
+}
+
+type gcloudIDTokenSource struct {
+	ctx      context.Context
+	name     string
+	audience string
+	gcloud   *gcloudCommand
+}
+
+func (s *gcloudIDTokenSource) Token() (*oauth2.Token, error) {
+	ss := []string{
+		"auth", "print-identity-token",
+	}
+	if s.audience != "" {
+		ss = append(ss, "--audiences="+s.audience)
+	}
+	if s.name != "" {
+		ss = append(ss, s.name)
+	}
+	bs, err := s.gcloud.run(s.ctx, ss...)
+	if err != nil {
+		return nil, err
+	}
+	return idTokenToOAuth2Token(strings.TrimSpace(string(bs)))
+}
+
+// idTokenToOAuth2Token returns an oauth2.Token that holds the ID token in
+// AccessToken. The expiry is taken from the token claims.
+func idTokenToOAuth2Token(idToken string) (*oauth2.Token, error) {
+	claims, err := jws.Decode(idToken)
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot decode the ID token: %w", err)
+	}
+	return &oauth2.Token{
+		AccessToken: idToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Unix(claims.Exp, 0),
+	}, nil
+}
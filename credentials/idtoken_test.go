@@ -0,0 +1,208 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/iamcredentials/v1"
+)
+
+const testIDTokenAudience = "123-abc.apps.googleusercontent.com"
+
+// fakeIDToken returns an unsigned JWT with the subject and the expiry.
+func fakeIDToken(sub string, exp time.Time) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	claims := fmt.Sprintf(`{"aud": %q, "sub": %q, "exp": %d}`, testIDTokenAudience, sub, exp.Unix())
+	return enc([]byte(`{"alg": "RS256", "typ": "JWT"}`)) + "." + enc([]byte(claims)) + "." + enc([]byte("signature"))
+}
+
+func TestIAMIDTokenSource(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/v1/projects/-/serviceAccounts/ci@example.iam.gserviceaccount.com:generateIdToken"; got != want {
+			t.Errorf("got path %q, want %q", got, want)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer source"; got != want {
+			t.Errorf("got Authorization %q, want %q", got, want)
+		}
+		req := &iamcredentials.GenerateIdTokenRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("cannot parse the request: %v", err)
+		}
+		if req.Audience != testIDTokenAudience || !req.IncludeEmail {
+			t.Errorf("got audience %q and includeEmail %t", req.Audience, req.IncludeEmail)
+		}
+		if want := []string{"projects/-/serviceAccounts/hop@example.iam.gserviceaccount.com"}; !reflect.DeepEqual(req.Delegates, want) {
+			t.Errorf("got delegates %q, want %q", req.Delegates, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&iamcredentials.GenerateIdTokenResponse{Token: fakeIDToken("ci", exp)})
+	}))
+	defer srv.Close()
+	defer func(e string) { iamCredentialsEndpoint = e }(iamCredentialsEndpoint)
+	iamCredentialsEndpoint = srv.URL + "/"
+	source := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "source"})
+	delegates := []string{"hop@example.iam.gserviceaccount.com"}
+
+	ts, err := newIAMIDTokenSource(context.Background(), source, "ci@example.iam.gserviceaccount.com", delegates, testIDTokenAudience, 0)
+	if err != nil {
+		t.Fatalf("newIAMIDTokenSource: %v", err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != fakeIDToken("ci", exp) || !token.Expiry.Equal(exp) {
+		t.Errorf("got %q expiring at %v, want the ID token expiring at %v", token.AccessToken, token.Expiry, exp)
+	}
+
+	if _, err := newIAMIDTokenSource(context.Background(), source, "ci@example.iam.gserviceaccount.com", nil, "", 0); err == nil {
+		t.Error("newIAMIDTokenSource succeeded without an audience, want an error")
+	}
+}
+
+func TestMetadataIDToken(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if got, want := r.URL.Path, "/computeMetadata/v1/instance/service-accounts/default/identity"; got != want {
+			t.Errorf("got path %q, want %q", got, want)
+		}
+		if got := r.URL.Query().Get("audience"); got != testIDTokenAudience {
+			t.Errorf("got audience %q, want %q", got, testIDTokenAudience)
+		}
+		fmt.Fprintln(w, fakeIDToken("metadata", exp))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv(metadataHostEnv, os.Getenv(metadataHostEnv))
+	os.Setenv(metadataHostEnv, u.Host)
+
+	ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+		Account:   "metadata",
+		TokenType: TokenTypeIDToken,
+		Audience:  testIDTokenAudience,
+	})
+	if err != nil {
+		t.Fatalf("TokenSourceFromConfig: %v", err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != fakeIDToken("metadata", exp) || !token.Expiry.Equal(exp) {
+		t.Errorf("got %q expiring at %v, want the ID token expiring at %v", token.AccessToken, token.Expiry, exp)
+	}
+
+	ts, err = TokenSourceFromConfig(context.Background(), &CredentialConfig{
+		Account:   "metadata",
+		TokenType: TokenTypeIDToken,
+	})
+	if err != nil {
+		t.Fatalf("TokenSourceFromConfig: %v", err)
+	}
+	if _, err := ts.Token(); err == nil {
+		t.Error("got an ID token without an audience, want an error")
+	}
+}
+
+func TestGcloudIDToken(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	dir, err := ioutil.TempDir("", "gcloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	// A gcloud that checks the arguments against GCLOUD_WANT_ARGS.
+	gcloud := filepath.Join(dir, "gcloud")
+	script := fmt.Sprintf(`#!/bin/sh
+test "$*" = "$GCLOUD_WANT_ARGS" || exit 1
+echo %s
+`, fakeIDToken("user", exp))
+	if err := ioutil.WriteFile(gcloud, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("GCLOUD_WANT_ARGS")
+	defer func(v string, ok bool) {
+		if ok {
+			os.Setenv("CLOUDSDK_CORE_ACCOUNT", v)
+		} else {
+			os.Unsetenv("CLOUDSDK_CORE_ACCOUNT")
+		}
+	}(os.LookupEnv("CLOUDSDK_CORE_ACCOUNT"))
+
+	for _, tc := range []struct {
+		account       string
+		activeAccount string
+		want          string
+	}{
+		// gcloud rejects audiences for Google Accounts.
+		{"user@example.com", "", "auth print-identity-token user@example.com"},
+		{"gcloud", "user@example.com", "auth print-identity-token"},
+		{"user:bot@example.iam.gserviceaccount.com", "", "auth print-identity-token --audiences=" + testIDTokenAudience + " bot@example.iam.gserviceaccount.com"},
+		{"gcloud", "bot@example.iam.gserviceaccount.com", "auth print-identity-token --audiences=" + testIDTokenAudience},
+	} {
+		os.Setenv("GCLOUD_WANT_ARGS", tc.want)
+		os.Setenv("CLOUDSDK_CORE_ACCOUNT", tc.activeAccount)
+		ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+			Account:    tc.account,
+			TokenType:  TokenTypeIDToken,
+			Audience:   testIDTokenAudience,
+			GcloudPath: gcloud,
+		})
+		if err != nil {
+			t.Fatalf("%s: TokenSourceFromConfig: %v", tc.account, err)
+		}
+		token, err := ts.Token()
+		if err != nil {
+			t.Errorf("%s: Token: %v, want gcloud to be run with %q", tc.account, err, tc.want)
+			continue
+		}
+		if token.AccessToken != fakeIDToken("user", exp) || !token.Expiry.Equal(exp) {
+			t.Errorf("%s: got %q expiring at %v, want the ID token expiring at %v", tc.account, token.AccessToken, token.Expiry, exp)
+		}
+	}
+
+	if _, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+		Account:   "user@example.com",
+		TokenType: "saml",
+	}); err == nil {
+		t.Error("an unknown token type is accepted")
+	}
+}
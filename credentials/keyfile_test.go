@@ -0,0 +1,114 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2/jws"
+)
+
+func TestKeyFileTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "exchanged-token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer tokenEndpoint.Close()
+
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.json")
+	bs, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "ci@example.iam.gserviceaccount.com",
+		"private_key_id": "key-id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)})),
+		"token_uri":      tokenEndpoint.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, bs, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("token endpoint", func(t *testing.T) {
+		ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+			Account: "keyfile:" + keyPath,
+		})
+		if err != nil {
+			t.Fatalf("TokenSourceFromConfig: %v", err)
+		}
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if token.AccessToken != "exchanged-token" {
+			t.Errorf("got %q, want exchanged-token", token.AccessToken)
+		}
+	})
+
+	t.Run("self-signed JWT", func(t *testing.T) {
+		ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+			Account:          "keyfile:" + keyPath,
+			Scopes:           []string{"scope1", "scope2"},
+			UseSelfSignedJWT: true,
+		})
+		if err != nil {
+			t.Fatalf("TokenSourceFromConfig: %v", err)
+		}
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if err := jws.Verify(token.AccessToken, &pk.PublicKey); err != nil {
+			t.Errorf("cannot verify the JWT: %v", err)
+		}
+		claims, err := jws.Decode(token.AccessToken)
+		if err != nil {
+			t.Fatalf("cannot decode the JWT: %v", err)
+		}
+		if claims.Iss != "ci@example.iam.gserviceaccount.com" || claims.Scope != "scope1 scope2" {
+			t.Errorf("unexpected claims: %+v", claims)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+			Account: "keyfile:" + filepath.Join(dir, "missing.json"),
+		}); err == nil {
+			t.Error("got no error for a missing key file")
+		}
+	})
+}
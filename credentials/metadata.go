@@ -0,0 +1,151 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// metadataHostEnv is the environment variable that overrides the GCE
+	// metadata server address. This is the same variable as the one used by
+	// the Cloud SDKs.
+	metadataHostEnv = "GCE_METADATA_HOST"
+	// defaultMetadataHost is the address of the GCE metadata server.
+	defaultMetadataHost = "169.254.169.254"
+
+	defaultMetadataServiceAccount = "default"
+)
+
+// metadataClient is the HTTP client for the metadata server. Outside of GCE,
+// connecting to the metadata server can hang. The short dial timeout makes
+// the account fail quickly, e.g. so that the next account in google.account
+// is tried.
+var metadataClient = &http.Client{
+	Transport: &http.Transport{
+		// The metadata server must not be accessed through a proxy.
+		Proxy:       nil,
+		DialContext: (&net.Dialer{Timeout: 2 * time.Second}).DialContext,
+	},
+}
+
+// metadataTokenSource obtains the tokens of a service account attached to the
+// GCE instance from the metadata server.
+type metadataTokenSource struct {
+	ctx            context.Context
+	serviceAccount string
+	scopes         []string
+	audience       string
+	idToken        bool
+}
+
+func newMetadataTokenSource(ctx context.Context, c *CredentialConfig, serviceAccount string, scopes []string) oauth2.TokenSource {
+	if serviceAccount == "" {
+		serviceAccount = defaultMetadataServiceAccount
+	}
+	return newMinLifetimeTokenSource(&metadataTokenSource{
+		ctx:            ctx,
+		serviceAccount: serviceAccount,
+		scopes:         scopes,
+		audience:       c.Audience,
+		idToken:        c.TokenType == TokenTypeIDToken,
+	}, c.MinTokenLifetime)
+}
+
+type metadataTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+func (s *metadataTokenSource) Token() (*oauth2.Token, error) {
+	if s.idToken {
+		if s.audience == "" {
+			return nil, xerrors.New("credentials: google.audience is required for ID tokens of the metadata server")
+		}
+		v := url.Values{}
+		v.Set("audience", s.audience)
+		v.Set("format", "full")
+		bs, err := s.get("identity", v)
+		if err != nil {
+			return nil, err
+		}
+		return idTokenToOAuth2Token(strings.TrimSpace(string(bs)))
+	}
+
+	v := url.Values{}
+	if len(s.scopes) != 0 {
+		v.Set("scopes", strings.Join(s.scopes, ","))
+	}
+	bs, err := s.get("token", v)
+	if err != nil {
+		return nil, err
+	}
+	resp := &metadataTokenResponse{}
+	if err := json.Unmarshal(bs, resp); err != nil {
+		return nil, xerrors.Errorf("credentials: cannot parse the metadata server token: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return nil, xerrors.New("credentials: the metadata server returned no access token")
+	}
+	return &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   resp.TokenType,
+		Expiry:      time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (s *metadataTokenSource) get(suffix string, v url.Values) ([]byte, error) {
+	host := os.Getenv(metadataHostEnv)
+	if host == "" {
+		host = defaultMetadataHost
+	}
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     "/computeMetadata/v1/instance/service-accounts/" + s.serviceAccount + "/" + suffix,
+		RawQuery: v.Encode(),
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot create a metadata server request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := metadataClient.Do(req.WithContext(s.ctx))
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot access the metadata server: %w", newAPIError("GCE metadata server", err))
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot read the metadata server response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("credentials: cannot get a token of %s: %w", s.serviceAccount, newHTTPAPIError("GCE metadata server", resp.StatusCode, strings.TrimSpace(string(bs))))
+	}
+	return bs, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestMetadataTokenSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var token string
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			token = "default-token"
+		case "/computeMetadata/v1/instance/service-accounts/builder@example.iam.gserviceaccount.com/token":
+			token = "builder-token"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if got, want := r.URL.Query().Get("scopes"), "scope1,scope2"; got != want {
+			t.Errorf("got scopes %q, want %q", got, want)
+		}
+		json.NewEncoder(w).Encode(&metadataTokenResponse{
+			AccessToken: token,
+			ExpiresIn:   3599,
+			TokenType:   "Bearer",
+		})
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv(metadataHostEnv, os.Getenv(metadataHostEnv))
+	os.Setenv(metadataHostEnv, u.Host)
+
+	for _, tc := range []struct {
+		account string
+		want    string
+		wantErr bool
+	}{
+		{account: "metadata", want: "default-token"},
+		{account: "metadata:default", want: "default-token"},
+		{account: "metadata:builder@example.iam.gserviceaccount.com", want: "builder-token"},
+		{account: "metadata:unknown", wantErr: true},
+	} {
+		t.Run(tc.account, func(t *testing.T) {
+			ts, err := TokenSourceFromConfig(context.Background(), &CredentialConfig{
+				Account: tc.account,
+				Scopes:  []string{"scope1", "scope2"},
+			})
+			if err != nil {
+				t.Fatalf("TokenSourceFromConfig: %v", err)
+			}
+			token, err := ts.Token()
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if err == nil && token.AccessToken != tc.want {
+				t.Errorf("got %q, want %q", token.AccessToken, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// This file implements a minimal read-only reader of SQLite 3 database files.
+// It supports only what is needed to read gcloud's credential store: full
+// scans of rowid tables in UTF-8 databases without a pending write-ahead log.
+// See https://www.sqlite.org/fileformat2.html for the file format.
+
+const (
+	sqliteHeader     = "SQLite format 3\x00"
+	sqliteHeaderSize = 100
+
+	sqlitePageInteriorTable = 0x05
+	sqlitePageLeafTable     = 0x0d
+
+	// sqliteMaxDepth bounds the b-tree depth so that a broken file cannot
+	// make the reader loop forever.
+	sqliteMaxDepth = 32
+)
+
+// errSQLiteUnsupported means that the file is not a database this reader can
+// read.
+var errSQLiteUnsupported = xerrors.New("unsupported SQLite database")
+
+type sqliteDB struct {
+	data     []byte
+	pageSize int
+	// usable is the page size minus the reserved space at the end of the
+	// pages.
+	usable int
+}
+
+// readSQLiteTable returns all rows of the table in the SQLite database file.
+// Each row maps the column names to the values, which are nil, int64,
+// float64, string or []byte.
+func readSQLiteTable(path, table string) ([]map[string]interface{}, error) {
+	if fi, err := os.Stat(path + "-wal"); err == nil && fi.Size() > 0 {
+		// The latest data can be in the log.
+		return nil, xerrors.Errorf("%s has a write-ahead log: %w", path, errSQLiteUnsupported)
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseSQLiteDB(bs)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", path, err)
+	}
+	rows, err := db.readTable(table)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", path, err)
+	}
+	return rows, nil
+}
+
+func parseSQLiteDB(bs []byte) (*sqliteDB, error) {
+	if len(bs) < sqliteHeaderSize || string(bs[:len(sqliteHeader)]) != sqliteHeader {
+		return nil, xerrors.Errorf("not a SQLite 3 file: %w", errSQLiteUnsupported)
+	}
+	pageSize := int(binary.BigEndian.Uint16(bs[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, xerrors.Errorf("invalid page size %d: %w", pageSize, errSQLiteUnsupported)
+	}
+	if enc := binary.BigEndian.Uint32(bs[56:60]); enc != 1 {
+		return nil, xerrors.Errorf("text encoding %d is not UTF-8: %w", enc, errSQLiteUnsupported)
+	}
+	return &sqliteDB{
+		data:     bs,
+		pageSize: pageSize,
+		usable:   pageSize - int(bs[20]),
+	}, nil
+}
+
+func (db *sqliteDB) readTable(name string) ([]map[string]interface{}, error) {
+	// The schema table is rooted at the page 1.
+	schema, err := db.scan(1)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range schema {
+		// type, name, tbl_name, rootpage, sql
+		if len(r) != 5 || r[0] != "table" || r[1] != name {
+			continue
+		}
+		root, ok := r[3].(int64)
+		if !ok || root < 1 || root > int64(len(db.data)/db.pageSize) {
+			return nil, xerrors.Errorf("invalid root page of %s: %w", name, errSQLiteUnsupported)
+		}
+		sql, _ := r[4].(string)
+		columns, err := parseSQLiteColumns(sql)
+		if err != nil {
+			return nil, err
+		}
+		records, err := db.scan(int(root))
+		if err != nil {
+			return nil, err
+		}
+		rows := []map[string]interface{}{}
+		for _, rec := range records {
+			row := map[string]interface{}{}
+			for i, col := range columns {
+				if i < len(rec) {
+					row[col] = rec[i]
+				} else {
+					// Columns added by ALTER TABLE can be missing
+					// in the old records.
+					row[col] = nil
+				}
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+	return nil, xerrors.Errorf("no table %s: %w", name, errSQLiteUnsupported)
+}
+
+// page returns the content of the page. The page numbers start from 1.
+func (db *sqliteDB) page(n int) ([]byte, error) {
+	// n is compared before the multiplication, which can overflow.
+	if n < 1 || n > len(db.data)/db.pageSize {
+		return nil, xerrors.Errorf("page %d is out of range: %w", n, errSQLiteUnsupported)
+	}
+	return db.data[(n-1)*db.pageSize : (n-1)*db.pageSize+db.usable], nil
+}
+
+// scan returns the records of the table b-tree rooted at the page in the
+// rowid order.
+func (db *sqliteDB) scan(root int) ([][]interface{}, error) {
+	var records [][]interface{}
+	if err := db.scanPage(root, 0, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (db *sqliteDB) scanPage(n, depth int, records *[][]interface{}) error {
+	if depth > sqliteMaxDepth {
+		return xerrors.Errorf("b-tree is too deep: %w", errSQLiteUnsupported)
+	}
+	p, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	hdr := 0
+	if n == 1 {
+		hdr = sqliteHeaderSize
+	}
+	if len(p) < hdr+12 {
+		return xerrors.Errorf("page %d is too short: %w", n, errSQLiteUnsupported)
+	}
+	kind := p[hdr]
+	cells := int(binary.BigEndian.Uint16(p[hdr+3 : hdr+5]))
+	var ptrs []byte
+	switch kind {
+	case sqlitePageInteriorTable:
+		ptrs = p[hdr+12:]
+	case sqlitePageLeafTable:
+		ptrs = p[hdr+8:]
+	default:
+		return xerrors.Errorf("page %d has an unknown type %#x: %w", n, kind, errSQLiteUnsupported)
+	}
+	if len(ptrs) < cells*2 {
+		return xerrors.Errorf("page %d has too many cells: %w", n, errSQLiteUnsupported)
+	}
+
+	for i := 0; i < cells; i++ {
+		off := int(binary.BigEndian.Uint16(ptrs[i*2:]))
+		if off >= len(p) {
+			return xerrors.Errorf("page %d has a broken cell: %w", n, errSQLiteUnsupported)
+		}
+		cell := p[off:]
+		if kind == sqlitePageInteriorTable {
+			if len(cell) < 4 {
+				return xerrors.Errorf("page %d has a broken cell: %w", n, errSQLiteUnsupported)
+			}
+			if err := db.scanPage(int(binary.BigEndian.Uint32(cell)), depth+1, records); err != nil {
+				return err
+			}
+			continue
+		}
+		rec, err := db.readLeafCell(cell)
+		if err != nil {
+			return xerrors.Errorf("page %d: %w", n, err)
+		}
+		*records = append(*records, rec)
+	}
+	if kind == sqlitePageInteriorTable {
+		return db.scanPage(int(binary.BigEndian.Uint32(p[hdr+8:])), depth+1, records)
+	}
+	return nil
+}
+
+// readLeafCell parses a cell of a table b-tree leaf page.
+func (db *sqliteDB) readLeafCell(cell []byte) ([]interface{}, error) {
+	size, n := sqliteVarint(cell)
+	if n == 0 || size > uint64(len(db.data)) {
+		return nil, xerrors.Errorf("broken payload size: %w", errSQLiteUnsupported)
+	}
+	cell = cell[n:]
+	if _, n = sqliteVarint(cell); n == 0 {
+		return nil, xerrors.Errorf("broken rowid: %w", errSQLiteUnsupported)
+	}
+	cell = cell[n:]
+
+	// Large payloads spill to the overflow pages. See "B-tree Pages" in
+	// the file format document for the computation of the local part.
+	u := db.usable
+	local := int(size)
+	if x := u - 35; int(size) > x {
+		m := (u-12)*32/255 - 23
+		k := m + (int(size)-m)%(u-4)
+		if k <= x {
+			local = k
+		} else {
+			local = m
+		}
+	}
+	if len(cell) < local {
+		return nil, xerrors.Errorf("broken cell: %w", errSQLiteUnsupported)
+	}
+	payload := make([]byte, 0, size)
+	payload = append(payload, cell[:local]...)
+	if local < int(size) {
+		if len(cell) < local+4 {
+			return nil, xerrors.Errorf("broken cell: %w", errSQLiteUnsupported)
+		}
+		next := int(binary.BigEndian.Uint32(cell[local:]))
+		for len(payload) < int(size) {
+			if next == 0 || len(payload) > len(db.data) {
+				return nil, xerrors.Errorf("broken overflow chain: %w", errSQLiteUnsupported)
+			}
+			p, err := db.page(next)
+			if err != nil {
+				return nil, err
+			}
+			next = int(binary.BigEndian.Uint32(p))
+			rest := p[4:]
+			if r := int(size) - len(payload); len(rest) > r {
+				rest = rest[:r]
+			}
+			payload = append(payload, rest...)
+		}
+	}
+	return parseSQLiteRecord(payload)
+}
+
+// parseSQLiteRecord parses a record in the SQLite record format.
+func parseSQLiteRecord(bs []byte) ([]interface{}, error) {
+	hdrSize, n := sqliteVarint(bs)
+	if n == 0 || hdrSize > uint64(len(bs)) || hdrSize < uint64(n) {
+		return nil, xerrors.Errorf("broken record header: %w", errSQLiteUnsupported)
+	}
+	hdr := bs[n:hdrSize]
+	body := bs[hdrSize:]
+	var values []interface{}
+	for len(hdr) > 0 {
+		typ, n := sqliteVarint(hdr)
+		if n == 0 {
+			return nil, xerrors.Errorf("broken record header: %w", errSQLiteUnsupported)
+		}
+		hdr = hdr[n:]
+
+		var size int
+		switch {
+		case typ <= 4:
+			size = int(typ)
+		case typ == 5:
+			size = 6
+		case typ == 6, typ == 7:
+			size = 8
+		case typ == 8, typ == 9:
+			size = 0
+		case typ >= 12:
+			// typ is bounded before the conversion, which can
+			// overflow.
+			if (typ-12)/2 > uint64(len(body)) {
+				return nil, xerrors.Errorf("broken record: %w", errSQLiteUnsupported)
+			}
+			size = int(typ-12) / 2
+		default:
+			return nil, xerrors.Errorf("unknown serial type %d: %w", typ, errSQLiteUnsupported)
+		}
+		if len(body) < size {
+			return nil, xerrors.Errorf("broken record: %w", errSQLiteUnsupported)
+		}
+		v := body[:size]
+		body = body[size:]
+
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case typ <= 6:
+			// Big-endian two's complement integers.
+			var i int64
+			if v[0]&0x80 != 0 {
+				i = -1
+			}
+			for _, b := range v {
+				i = i<<8 | int64(b)
+			}
+			values = append(values, i)
+		case typ == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case typ == 8:
+			values = append(values, int64(0))
+		case typ == 9:
+			values = append(values, int64(1))
+		case typ%2 == 0:
+			values = append(values, append([]byte(nil), v...))
+		default:
+			values = append(values, string(v))
+		}
+	}
+	return values, nil
+}
+
+// sqliteVarint decodes a SQLite variable-length integer. It returns the
+// number of bytes read, or zero if bs is too short.
+func sqliteVarint(bs []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(bs) {
+			return 0, 0
+		}
+		if i == 8 {
+			return v<<8 | uint64(bs[i]), 9
+		}
+		v = v<<7 | uint64(bs[i]&0x7f)
+		if bs[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// parseSQLiteColumns returns the column names in the CREATE TABLE statement.
+func parseSQLiteColumns(sql string) ([]string, error) {
+	start := strings.Index(sql, "(")
+	end := strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return nil, xerrors.Errorf("cannot parse %q: %w", sql, errSQLiteUnsupported)
+	}
+	var columns []string
+	for _, def := range splitSQLiteDefs(sql[start+1 : end]) {
+		fs := strings.Fields(def)
+		if len(fs) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fs[0]) {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			// Table constraints follow the columns.
+			return columns, nil
+		}
+		columns = append(columns, strings.Trim(fs[0], "\"`[]'"))
+	}
+	return columns, nil
+}
+
+// splitSQLiteDefs splits the column definitions by the commas that are not in
+// parentheses or quotes.
+func splitSQLiteDefs(s string) []string {
+	var defs []string
+	var cur bytes.Buffer
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		case ch == ',' && depth == 0:
+			defs = append(defs, cur.String())
+			cur.Reset()
+			continue
+		}
+		cur.WriteByte(ch)
+	}
+	return append(defs, cur.String())
+}
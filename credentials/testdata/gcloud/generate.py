@@ -0,0 +1,77 @@
+#!/usr/bin/env python3
+# Copyright 2019 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     https://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+"""Generates the fixture databases in the same schema as gcloud."""
+
+import datetime
+import json
+import os
+import sqlite3
+
+DIR = os.path.dirname(os.path.abspath(__file__))
+
+
+def credential(refresh_token):
+    return json.dumps({
+        "client_id": "client-id",
+        "client_secret": "client-secret",
+        "refresh_token": refresh_token,
+        "revoke_uri": "https://oauth2.googleapis.com/revoke",
+        "scopes": ["openid", "https://www.googleapis.com/auth/cloud-platform"],
+        "token_uri": "https://oauth2.googleapis.com/token",
+        "type": "authorized_user",
+    })
+
+
+def main():
+    for name in ("credentials.db", "access_tokens.db"):
+        path = os.path.join(DIR, name)
+        if os.path.exists(path):
+            os.remove(path)
+
+    db = sqlite3.connect(os.path.join(DIR, "credentials.db"))
+    db.execute('CREATE TABLE IF NOT EXISTS "credentials" '
+               '(account_id TEXT PRIMARY KEY, value BLOB)')
+    rows = [
+        ("cached@example.com", credential("refresh-cached")),
+        ("expired@example.com", credential("refresh-expired")),
+        # The refresh token spills to the overflow pages.
+        ("long@example.com", credential("refresh-" + "x" * 10000)),
+        ("external@example.com",
+         json.dumps({"type": "external_account"})),
+    ]
+    # Filler accounts make the table b-tree have interior pages.
+    rows += [("filler-%03d@example.com" % i, credential("filler-%03d" % i))
+             for i in range(100)]
+    db.executemany('INSERT INTO "credentials" VALUES (?, ?)', rows)
+    db.commit()
+    db.close()
+
+    db = sqlite3.connect(os.path.join(DIR, "access_tokens.db"))
+    db.execute('CREATE TABLE IF NOT EXISTS "access_tokens" '
+               '(account_id TEXT PRIMARY KEY, access_token TEXT, '
+               'token_expiry TIMESTAMP, rapt_token TEXT, id_token TEXT)')
+    db.executemany('INSERT INTO "access_tokens" VALUES (?, ?, ?, ?, ?)', [
+        ("cached@example.com", "cached-access-token",
+         str(datetime.datetime(2099, 1, 1, 0, 0, 0, 123456)), None, None),
+        ("expired@example.com", "expired-access-token",
+         str(datetime.datetime(2020, 1, 1)), "rapt-token", None),
+    ])
+    db.commit()
+    db.close()
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,359 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// cachedTokenExpiryDelta is how long before its expiry a cached token
+	// stops being reused.
+	cachedTokenExpiryDelta = 2 * time.Minute
+
+	// lockPollInterval is how often a token cache locked by another
+	// process is checked.
+	lockPollInterval = 50 * time.Millisecond
+)
+
+// DefaultTokenCacheDir returns the directory used for the token cache when
+// google.tokenCacheDir is not specified.
+func DefaultTokenCacheDir() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", xerrors.Errorf("credentials: cannot find the user cache directory: %w", err)
+	}
+	return filepath.Join(d, "googlesource-auth-tools", "tokens"), nil
+}
+
+// cacheKey returns a file name safe key identifying the tokens minted for the
+// given accounts and scopes with the config. It returns false if the tokens
+// must not be cached because the credentials behind an account cannot be
+// identified.
+func cacheKey(c *CredentialConfig, accounts []Account, scopes []string) (string, bool) {
+	var names, identities []string
+	for _, a := range accounts {
+		names = append(names, a.String())
+		id, ok := credentialIdentity(c, a)
+		if !ok {
+			return "", false
+		}
+		identities = append(identities, id)
+	}
+	k := struct {
+		Account         string                 `json:"account"`
+		Identities      []string               `json:"identities,omitempty"`
+		Scopes          []string               `json:"scopes"`
+		Delegates       []string               `json:"delegates"`
+		TokenType       string                 `json:"tokenType,omitempty"`
+		Audience        string                 `json:"audience,omitempty"`
+		GcloudConfig    string                 `json:"gcloudConfiguration,omitempty"`
+		GcloudConfigDir string                 `json:"gcloudConfigDir,omitempty"`
+		TokenLifetime   time.Duration          `json:"tokenLifetime,omitempty"`
+		SelfSignedJWT   bool                   `json:"selfSignedJWT,omitempty"`
+		URL             string                 `json:"url,omitempty"`
+		ExternalAccount *ExternalAccountConfig `json:"externalAccount,omitempty"`
+	}{
+		Account:    strings.Join(names, ","),
+		Identities: identities,
+		Scopes:     scopes,
+		Delegates:  c.ServiceAccountDelegateEmails,
+		TokenType:  c.TokenType,
+		Audience:   c.Audience,
+		// The same account can have different credentials in different
+		// gcloud configurations.
+		GcloudConfig:    c.GcloudConfiguration,
+		GcloudConfigDir: c.GcloudConfigDir,
+		// A host can require shorter tokens than the others.
+		TokenLifetime: c.TokenLifetime,
+	}
+	for _, a := range accounts {
+		if a.Kind == AccountKindKeyFile {
+			k.SelfSignedJWT = c.UseSelfSignedJWT
+		}
+		if a.Kind == AccountKindExternalAccount {
+			k.ExternalAccount = &c.ExternalAccount
+		}
+		if a.Kind == AccountKindExec && c.URL != nil {
+			// The command can take the URL as an argument.
+			k.URL = c.URL.String()
+		}
+	}
+	bs, err := json.Marshal(k)
+	if err != nil {
+		// Marshaling strings never fails.
+		panic(err)
+	}
+	h := sha256.Sum256(bs)
+	return hex.EncodeToString(h[:]), true
+}
+
+// credentialIdentity returns what identifies the credentials behind an account
+// whose value doesn't tell them: the active gcloud account for `gcloud`, and
+// the application default credentials for `application-default`. Service
+// accounts are identified with the credentials that impersonate them. It
+// returns false if the credentials cannot be identified.
+func credentialIdentity(c *CredentialConfig, a Account) (string, bool) {
+	switch a.Kind {
+	case AccountKindGcloud:
+		dir := c.GcloudConfigDir
+		if dir == "" {
+			var err error
+			if dir, err = defaultGcloudConfigDir(); err != nil {
+				return "", false
+			}
+		}
+		account, err := gcloudActiveAccount(dir, c.GcloudConfiguration)
+		if err != nil {
+			return "", false
+		}
+		return "gcloud:" + account, true
+
+	case AccountKindApplicationDefault:
+		return applicationDefaultIdentity()
+
+	case AccountKindServiceAccount:
+		if c.ImpersonationSource == "" {
+			return applicationDefaultIdentity()
+		}
+		source, err := ParseAccount(c.ImpersonationSource)
+		if err != nil || source.Kind == AccountKindServiceAccount {
+			return "", false
+		}
+		return credentialIdentity(c, source)
+	}
+	return "", true
+}
+
+// applicationDefaultIdentity identifies the application default credentials
+// by the hash of the credential file, found in the same way as
+// google.DefaultTokenSource. Without the file, the metadata server is used.
+func applicationDefaultIdentity() (string, bool) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		const f = "application_default_credentials.json"
+		if runtime.GOOS == "windows" {
+			path = filepath.Join(os.Getenv("APPDATA"), "gcloud", f)
+		} else {
+			home := os.Getenv("HOME")
+			if home == "" {
+				u, err := user.Current()
+				if err != nil {
+					return "", false
+				}
+				home = u.HomeDir
+			}
+			path = filepath.Join(home, ".config", "gcloud", f)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return "adc:metadata", true
+		}
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	h := sha256.Sum256(bs)
+	return "adc:" + hex.EncodeToString(h[:]), true
+}
+
+// cachedTokenSource is a TokenSource that shares the tokens through a file
+// among processes.
+//
+// The cache file is guarded by a file lock that is held while a new token is
+// minted. When multiple processes need a token at the same time, only one of
+// them calls the underlying TokenSource and the others read its result.
+type cachedTokenSource struct {
+	ctx  context.Context
+	path string
+	base oauth2.TokenSource
+	// The cached token is not used if it expires sooner than this.
+	minLifetime time.Duration
+}
+
+func newCachedTokenSource(ctx context.Context, dir, key string, base oauth2.TokenSource) *cachedTokenSource {
+	return &cachedTokenSource{
+		ctx:  ctx,
+		path: filepath.Join(dir, key+".json"),
+		base: base,
+	}
+}
+
+func (s *cachedTokenSource) Token() (*oauth2.Token, error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return nil, xerrors.Errorf("credentials: cannot create the token cache directory: %w", err)
+	}
+	l, err := lockFile(s.ctx, s.path+".lock")
+	if err != nil {
+		return nil, xerrors.Errorf("credentials: cannot lock the token cache: %w", err)
+	}
+	defer l.unlock()
+
+	if token, err := s.read(); err == nil && cachedTokenValid(token, time.Now(), s.minLifetime) {
+		return token, nil
+	}
+
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	// The cache is an optimization. Failing to write it shouldn't fail the
+	// token request.
+	s.write(token)
+	return token, nil
+}
+
+// lockFile locks the file exclusively. It waits until the lock is acquired or
+// the context is done.
+func lockFile(ctx context.Context, path string) (*fileLock, error) {
+	for {
+		l, err := tryLockFile(path)
+		if err != nil || l != nil {
+			return l, err
+		}
+		t := time.NewTimer(lockPollInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (s *cachedTokenSource) read() (*oauth2.Token, error) {
+	bs, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(bs, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *cachedTokenSource) write(token *oauth2.Token) error {
+	if token.Expiry.IsZero() {
+		// A token without an expiry cannot be invalidated. Do not
+		// persist it.
+		return nil
+	}
+	// Do not persist the refresh token or the extra fields.
+	bs, err := json.Marshal(&oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      token.Expiry,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// cachedTokenValid reports whether the token is valid for at least
+// minLifetime, or cachedTokenExpiryDelta if that's longer.
+func cachedTokenValid(token *oauth2.Token, now time.Time, minLifetime time.Duration) bool {
+	if token.AccessToken == "" || token.Expiry.IsZero() {
+		return false
+	}
+	margin := cachedTokenExpiryDelta
+	if minLifetime > margin {
+		margin = minLifetime
+	}
+	return now.Add(margin).Before(token.Expiry)
+}
+
+// minLifetimeTokenSource reuses the token while it's valid for at least
+// minLifetime. Unlike oauth2.ReuseTokenSource, which refreshes the token only
+// seconds before it expires, this makes sure that the returned token lasts
+// for a long operation such as a large git clone.
+type minLifetimeTokenSource struct {
+	mu          sync.Mutex
+	base        oauth2.TokenSource
+	minLifetime time.Duration
+	token       *oauth2.Token
+	// newBase is set for a base that reuses its token by itself. It's
+	// called for a new base instead of asking the base again.
+	newBase func() (oauth2.TokenSource, error)
+}
+
+func newMinLifetimeTokenSource(base oauth2.TokenSource, minLifetime time.Duration) oauth2.TokenSource {
+	if minLifetime <= 0 {
+		return oauth2.ReuseTokenSource(nil, base)
+	}
+	return &minLifetimeTokenSource{base: base, minLifetime: minLifetime}
+}
+
+// newRenewingTokenSource is newMinLifetimeTokenSource for the TokenSources
+// that reuse the tokens by themselves until seconds before they expire, such
+// as the ones of the oauth2 library. When the token is shorter than
+// minLifetime, a new TokenSource is created by newBase for a new token.
+func newRenewingTokenSource(newBase func() (oauth2.TokenSource, error), minLifetime time.Duration) (oauth2.TokenSource, error) {
+	base, err := newBase()
+	if err != nil || minLifetime <= 0 {
+		return base, err
+	}
+	return &minLifetimeTokenSource{base: base, minLifetime: minLifetime, newBase: newBase}, nil
+}
+
+func (s *minLifetimeTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != nil && (s.token.Expiry.IsZero() || time.Until(s.token.Expiry) >= s.minLifetime) {
+		return s.token, nil
+	}
+	if s.token != nil && s.newBase != nil {
+		// The base would return the same token.
+		base, err := s.newBase()
+		if err != nil {
+			return nil, err
+		}
+		s.base = base
+	}
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return token, nil
+}
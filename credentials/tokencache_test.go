@@ -0,0 +1,283 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type countingTokenSource struct {
+	mu       sync.Mutex
+	n        int
+	lifetime time.Duration
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	return &oauth2.Token{
+		AccessToken: fmt.Sprintf("token-%d", s.n),
+		Expiry:      time.Now().Add(s.lifetime),
+	}, nil
+}
+
+func TestCachedTokenSourceShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokencache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := &countingTokenSource{lifetime: time.Hour}
+	key, _ := cacheKey(&CredentialConfig{}, []Account{{Kind: AccountKindUser, Value: "user@example.com"}}, []string{scopeCloudPlatform})
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each goroutine has its own TokenSource as if it's a
+			// separate process.
+			token, err := newCachedTokenSource(context.Background(), dir, key, base).Token()
+			if err != nil {
+				t.Errorf("Token: %v", err)
+				return
+			}
+			tokens[i] = token.AccessToken
+		}(i)
+	}
+	wg.Wait()
+
+	if base.n != 1 {
+		t.Errorf("minted %d tokens, want 1", base.n)
+	}
+	for _, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("got %q, want token-1", token)
+		}
+	}
+}
+
+func TestCachedTokenSourceExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokencache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Tokens that expire within cachedTokenExpiryDelta are not reused.
+	base := &countingTokenSource{lifetime: time.Minute}
+	key, _ := cacheKey(&CredentialConfig{}, []Account{{Kind: AccountKindUser, Value: "user@example.com"}}, []string{scopeCloudPlatform})
+	for i := 1; i <= 2; i++ {
+		token, err := newCachedTokenSource(context.Background(), dir, key, base).Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if want := fmt.Sprintf("token-%d", i); token.AccessToken != want {
+			t.Errorf("got %q, want %q", token.AccessToken, want)
+		}
+	}
+}
+
+func TestMinTokenLifetime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokencache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A token valid for 10 minutes is reused without google.minTokenLifetime,
+	// but not with 15 minutes.
+	base := &countingTokenSource{lifetime: 10 * time.Minute}
+	key, _ := cacheKey(&CredentialConfig{}, []Account{{Kind: AccountKindUser, Value: "user@example.com"}}, []string{scopeCloudPlatform})
+	for _, tc := range []struct {
+		minLifetime time.Duration
+		want        string
+	}{
+		{0, "token-1"},
+		{0, "token-1"},
+		{15 * time.Minute, "token-2"},
+		{15 * time.Minute, "token-3"},
+		{5 * time.Minute, "token-3"},
+	} {
+		cached := newCachedTokenSource(context.Background(), dir, key, base)
+		cached.minLifetime = tc.minLifetime
+		token, err := newMinLifetimeTokenSource(cached, tc.minLifetime).Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if token.AccessToken != tc.want {
+			t.Errorf("minLifetime %v: got %q, want %q", tc.minLifetime, token.AccessToken, tc.want)
+		}
+	}
+
+	// The TokenSource reuses the token in memory only while it's valid for
+	// minLifetime.
+	base = &countingTokenSource{lifetime: 10 * time.Minute}
+	ts := newMinLifetimeTokenSource(base, 15*time.Minute)
+	for i := 1; i <= 2; i++ {
+		if _, err := ts.Token(); err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+	}
+	if base.n != 2 {
+		t.Errorf("minted %d tokens, want 2", base.n)
+	}
+	// A base that reuses its token by itself is created again.
+	base = &countingTokenSource{lifetime: 10 * time.Minute}
+	ts, err = newRenewingTokenSource(func() (oauth2.TokenSource, error) {
+		return oauth2.ReuseTokenSource(nil, base), nil
+	}, 15*time.Minute)
+	if err != nil {
+		t.Fatalf("newRenewingTokenSource: %v", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err := ts.Token(); err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+	}
+	if base.n != 2 {
+		t.Errorf("minted %d tokens with a reusing base, want 2", base.n)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// The leaf TokenSources from TokenSourceFromConfig reuse the token only
+	// while it's valid for minLifetime, too.
+	script := filepath.Join(dir, "broker")
+	count := filepath.Join(dir, "count")
+	if err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo >> `+count+`
+echo '{"access_token": "token", "expires_in": 600}'
+`), 0700); err != nil {
+		t.Fatal(err)
+	}
+	ts, err = TokenSourceFromConfig(context.Background(), &CredentialConfig{
+		Account:          "exec:" + script,
+		MinTokenLifetime: 15 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("TokenSourceFromConfig: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := ts.Token(); err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+	}
+	if bs, err := ioutil.ReadFile(count); err != nil || len(bs) != 3 {
+		t.Errorf("ran the command %d times, want 3 (%v)", len(bs), err)
+	}
+}
+
+func TestIAMTokenLifetime(t *testing.T) {
+	for _, tc := range []struct {
+		tokenLifetime time.Duration
+		minLifetime   time.Duration
+		want          string
+		wantErr       bool
+	}{
+		{0, 0, "", false},
+		{0, 30 * time.Minute, "", false},
+		{0, 2 * time.Hour, "7320s", false},
+		{0, 12*time.Hour - cachedTokenExpiryDelta, "43200s", false},
+		{0, 12 * time.Hour, "", true},
+		{10 * time.Minute, 0, "600s", false},
+		{12 * time.Hour, time.Hour, "43200s", false},
+		{13 * time.Hour, 0, "", true},
+		{time.Hour, 2 * time.Hour, "", true},
+	} {
+		got, err := iamTokenLifetime(tc.tokenLifetime, tc.minLifetime)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("iamTokenLifetime(%v, %v) returned error %v, want error %t", tc.tokenLifetime, tc.minLifetime, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("iamTokenLifetime(%v, %v) = %q, want %q", tc.tokenLifetime, tc.minLifetime, got, tc.want)
+		}
+	}
+}
+
+func TestCacheKeyIdentity(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for _, k := range []string{"CLOUDSDK_CONFIG", "CLOUDSDK_CORE_ACCOUNT", "CLOUDSDK_ACTIVE_CONFIG_NAME", "GOOGLE_APPLICATION_CREDENTIALS"} {
+		if v, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, v)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		os.Unsetenv(k)
+	}
+	c := &CredentialConfig{GcloudConfigDir: home}
+	key := func(a Account) (string, bool) {
+		return cacheKey(c, []Account{a}, []string{scopeCloudPlatform})
+	}
+	gcloud := Account{Kind: AccountKindGcloud}
+	adc := Account{Kind: AccountKindApplicationDefault}
+
+	if _, ok := key(gcloud); ok {
+		t.Error("cacheKey for gcloud without an active account is cacheable")
+	}
+	os.Setenv("CLOUDSDK_CORE_ACCOUNT", "a@example.com")
+	keyA, ok := key(gcloud)
+	os.Setenv("CLOUDSDK_CORE_ACCOUNT", "b@example.com")
+	keyB, _ := key(gcloud)
+	if !ok || keyA == keyB {
+		t.Errorf("cacheKey for gcloud doesn't change with the active account: %q, %q", keyA, keyB)
+	}
+
+	for i, content := range []string{`{"key": "a"}`, `{"key": "b"}`} {
+		p := filepath.Join(home, fmt.Sprintf("key%d.json", i))
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(home, "key0.json"))
+	keyA, ok = key(adc)
+	saA, _ := key(Account{Kind: AccountKindServiceAccount, Value: "sa@example.iam.gserviceaccount.com"})
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(home, "key1.json"))
+	keyB, _ = key(adc)
+	saB, _ := key(Account{Kind: AccountKindServiceAccount, Value: "sa@example.iam.gserviceaccount.com"})
+	if !ok || keyA == keyB || saA == saB {
+		t.Errorf("cacheKey doesn't change with GOOGLE_APPLICATION_CREDENTIALS: %q, %q, %q, %q", keyA, keyB, saA, saB)
+	}
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(home, "nonexistent.json"))
+	if _, ok := key(adc); ok {
+		t.Error("cacheKey for a missing GOOGLE_APPLICATION_CREDENTIALS is cacheable")
+	}
+
+	keyFile := Account{Kind: AccountKindKeyFile, Value: "/key.json"}
+	plain, _ := key(keyFile)
+	c.UseSelfSignedJWT = true
+	if jwt, _ := key(keyFile); jwt == plain {
+		t.Error("cacheKey doesn't change with UseSelfSignedJWT")
+	}
+}
@@ -40,6 +40,7 @@ func main() {
 
 	sc := bufio.NewScanner(os.Stdin)
 	var protocol, host, path string
+	var authTypeCapable bool
 	for sc.Scan() {
 		s := strings.TrimSpace(sc.Text())
 		if s == "" {
@@ -56,31 +57,64 @@ func main() {
 			host = ss[1]
 		case "path":
 			path = ss[1]
+		case "capability[]":
+			if ss[1] == "authtype" {
+				authTypeCapable = true
+			}
 		}
 	}
 	if err := sc.Err(); err != nil {
 		log.Fatalf("Cannot parse the git-credential input: %v", err)
 	}
 
-	if host != "source.developers.google.com" && !strings.HasSuffix(host, ".googlesource.com") {
-		return
-	}
-
 	u := &url.URL{}
 	u.Scheme = protocol
 	u.Host = host
 	u.Path = path
 
+	ctx := context.Background()
+	// Without git, the git-config files are read directly.
+	gitBinary, _ := credentials.FindGitBinary()
+	// Read git-config once for all the configs.
+	snapshot, err := gitBinary.Snapshot(ctx)
+	otherHost := !strings.HasSuffix(host, ".googlesource.com") && host != "source.developers.google.com"
+	if otherHost {
+		// Other hosts are handled only when they're configured to use ID
+		// tokens in their URL subsection, e.g. the Gerrit instances behind
+		// Identity-Aware Proxy. A global google.tokenType or the
+		// environment variable doesn't count, so that the tokens are not
+		// sent to any host. The host is left to the other credential
+		// helpers otherwise.
+		if err != nil {
+			return
+		}
+		tokenType, err := snapshot.URLSpecificStringConfig(ctx, u, "google.tokenType")
+		if err != nil || tokenType != credentials.TokenTypeIDToken {
+			return
+		}
+	} else if err != nil {
+		log.Fatalf("Cannot read git-config: %v", err)
+	}
+	gitConfig := credentials.WithEnvOverrides(snapshot)
+	tokenType, err := gitConfig.WithURL(u).StringConfig(ctx, "google.tokenType")
+	if err != nil {
+		log.Fatalf("Cannot get a config for google.tokenType: %v", err)
+	}
+	useIDToken := tokenType == credentials.TokenTypeIDToken
+	if otherHost && !useIDToken {
+		// The environment variable overrides the URL subsection.
+		return
+	}
+	if useIDToken && !authTypeCapable {
+		log.Fatalf("ID tokens require the bearer authentication, which is supported by Git 2.46 or later")
+	}
+
 	switch protocol {
 	case "https":
 		// OK
 	case "http":
-		gitBinary, err := credentials.FindGitBinary()
-		if err != nil {
-			log.Fatalf("Cannot find the git binary: %v", err)
-		}
-		g := gitBinary.WithURL(u)
-		allowHTTP, err := g.BoolConfig(context.Background(), "google.allowHTTPForCredentialHelper")
+		g := gitConfig.WithURL(u)
+		allowHTTP, err := g.BoolConfig(ctx, "google.allowHTTPForCredentialHelper")
 		if err != nil {
 			log.Fatalf("Cannot get a config for google.allowHTTPForCredentialHelper: %v", err)
 		}
@@ -91,18 +125,30 @@ func main() {
 		log.Fatalf("Unknown protocol: %s", protocol)
 	}
 
-	gitBinary, err := credentials.FindGitBinary()
+	token, err := credentials.MakeToken(ctx, gitConfig, u)
 	if err != nil {
-		log.Fatalf("Cannot find the git binary: %v", err)
+		exitWithError("Cannot get a token", err)
 	}
 
-	token, err := credentials.MakeToken(context.Background(), gitBinary, u)
-	if err != nil {
-		log.Fatalf("Cannot get a token: %v", err)
+	if useIDToken {
+		fmt.Printf("capability[]=authtype\n")
+		fmt.Printf("authtype=Bearer\n")
+		fmt.Printf("credential=%s\n", token.AccessToken)
+		fmt.Printf("ephemeral=1\n")
+		return
 	}
-
 	fmt.Printf("protocol=%s\n", protocol)
 	fmt.Printf("host=%s\n", host)
 	fmt.Printf("username=git-service-account\n")
 	fmt.Printf("password=%s\n", token.AccessToken)
 }
+
+// exitWithError logs the error with a hint on how to fix it, and exits with
+// the exit code for the error class.
+func exitWithError(msg string, err error) {
+	log.Printf("%s: %v", msg, err)
+	if hint := credentials.ErrorHint(err); hint != "" {
+		log.Print(hint)
+	}
+	os.Exit(credentials.ExitCode(err))
+}
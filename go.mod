@@ -7,6 +7,7 @@ require (
 	github.com/aki237/nscjar v0.0.0-20171019063319-e2df936ddd60
 	github.com/googleapis/gax-go v1.0.3
 	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
 	google.golang.org/api v0.35.0
 	google.golang.org/genproto v0.0.0-20201112120144-2985b7af83de
@@ -19,6 +19,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -27,26 +28,38 @@ import (
 	"github.com/google/googlesource-auth-tools/credentials"
 )
 
+var repo = flag.String("repo", "", "a path in the repository to read git-config for. Defaults to the current directory.")
+
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatalf("Usage: %s PROMPT", os.Args[0])
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("Usage: %s [--repo DIR] PROMPT", os.Args[0])
 	}
 
-	prompt := strings.ToLower(os.Args[1])
+	prompt := strings.ToLower(flag.Arg(0))
 	if strings.Contains(prompt, "username") {
 		fmt.Print("git-service-account")
 		return
 	} else if strings.Contains(prompt, "password") {
-		gitBinary, err := credentials.FindGitBinary()
-		if err != nil {
-			log.Fatalf("Cannot find the git binary: %v", err)
-		}
+		// Without git, the git-config files are read directly.
+		gitBinary, _ := credentials.FindGitBinary()
+		gitBinary.Dir = *repo
 		token, err := credentials.MakeToken(context.Background(), gitBinary, nil)
 		if err != nil {
-			log.Fatalf("Cannot get a token: %v", err)
+			exitWithError("Cannot get a token", err)
 		}
 		fmt.Print(token.AccessToken)
 		return
 	}
 	log.Fatalf("Unrecognized prompt")
 }
+
+// exitWithError logs the error with a hint on how to fix it, and exits with
+// the exit code for the error class.
+func exitWithError(msg string, err error) {
+	log.Printf("%s: %v", msg, err)
+	if hint := credentials.ErrorHint(err); hint != "" {
+		log.Print(hint)
+	}
+	os.Exit(credentials.ExitCode(err))
+}
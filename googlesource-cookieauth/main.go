@@ -20,16 +20,19 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/aki237/nscjar"
 	"github.com/google/googlesource-auth-tools/credentials"
+	"golang.org/x/oauth2"
 )
 
 const (
@@ -40,6 +43,8 @@ var (
 	configs StringList
 
 	runAsDaemon = flag.Bool("run-as-daemon", false, "run the process as a daemon. It refreshes the cookies every 45 minutes.")
+	repo        = flag.String("repo", "", "a path in the repository to read git-config for. Defaults to the current directory.")
+	explain     = flag.Bool("explain", false, "print the effective configs for each URL and where they come from, without obtaining tokens.")
 )
 
 func init() {
@@ -48,6 +53,12 @@ func init() {
 
 func main() {
 	flag.Parse()
+	if *explain {
+		if err := explainConfigs(context.Background(), os.Stdout); err != nil {
+			exitWithError("Cannot explain the configs", err)
+		}
+		return
+	}
 	if *runAsDaemon {
 		// See http://man7.org/linux/man-pages/man7/daemon.7.html for
 		// the new style daemons.
@@ -66,20 +77,81 @@ func main() {
 		}
 	} else {
 		if err := writeCookie(context.Background()); err != nil {
-			log.Fatalf("Cannot write cookies: %v", err)
+			exitWithError("Cannot write cookies", err)
 		}
 	}
 }
 
 func writeCookie(ctx context.Context) error {
-	gitBinary, err := credentials.FindGitBinary()
+	gitConfig, err := readGitConfig(ctx)
+	if err != nil {
+		return err
+	}
+	urls, err := cookieURLs(ctx, gitConfig)
+	if err != nil {
+		return err
+	}
+
+	cookies := []*http.Cookie{}
+	for _, u := range urls {
+		c, err := credentials.CredentialConfigFromConfig(ctx, credentials.WithEnvOverrides(gitConfig), u)
+		if err != nil {
+			return fmt.Errorf("cannot get the configs for %s: %w", u, err)
+		}
+		token, err := credentials.MakeTokenFromConfig(ctx, c)
+		if err != nil {
+			return fmt.Errorf("cannot create a token for %s: %w", u, err)
+		}
+		cookies = append(cookies, credentials.MakeCookiesFromConfig(c, token)...)
+	}
+
+	outputFile, err := cookieFile(ctx, gitConfig)
 	if err != nil {
-		return fmt.Errorf("cannot find the git binary: %v", err)
+		return err
+	}
+
+	var w *os.File
+	if outputFile == "-" {
+		w = os.Stdout
+	} else {
+		if err := os.MkdirAll(filepath.Dir(outputFile), 0700); err != nil {
+			return fmt.Errorf("cannot create the output directory: %v", err)
+		}
+		w, err = os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("cannot open the output file: %v", err)
+		}
+		defer w.Close()
+	}
+
+	fmt.Fprintf(w, "# Created by %s at %s\n", os.Args[0], time.Now().Format(time.RFC3339))
+	p := nscjar.Parser{}
+	for _, c := range cookies {
+		p.Marshal(w, c)
 	}
+	return nil
+}
+
+// readGitConfig reads git-config once for all the URLs.
+func readGitConfig(ctx context.Context) (*credentials.GitConfigSnapshot, error) {
+	// Without git, the git-config files are read directly.
+	gitBinary, _ := credentials.FindGitBinary()
 	gitBinary.Configs = configs
-	urls, err := gitBinary.ListURLs(ctx)
+	gitBinary.Dir = *repo
+	gitConfig, err := gitBinary.Snapshot(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot read the list of URLs in git-config: %v", err)
+		return nil, fmt.Errorf("cannot read git-config: %w", err)
+	}
+	return gitConfig, nil
+}
+
+// cookieURLs returns the URLs to write the cookies for. In addition to the
+// URLs in git-config, googlesource.com and source.developers.google.com are
+// always included.
+func cookieURLs(ctx context.Context, gitConfig *credentials.GitConfigSnapshot) ([]*url.URL, error) {
+	urls, err := gitConfig.ListURLs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the list of URLs in git-config: %v", err)
 	}
 	var hasGoogleSource, hasSourceDevelopers bool
 	for _, u := range urls {
@@ -96,48 +168,108 @@ func writeCookie(ctx context.Context) error {
 	if !hasSourceDevelopers {
 		urls = append(urls, &url.URL{Scheme: "https", Host: "source.developers.google.com"})
 	}
+	return urls, nil
+}
 
-	cookies := []*http.Cookie{}
-	for _, u := range urls {
-		token, err := credentials.MakeToken(ctx, gitBinary, u)
-		if err != nil {
-			return fmt.Errorf("cannot create a token for %s: %v", u, err)
-		}
-		cookies = append(cookies, credentials.MakeCookies(u, token)...)
-	}
-
-	outputFile, err := gitBinary.PathConfig(ctx, "google.cookieFile")
+// cookieFile returns the path of the cookie file, or "-" for stdout.
+func cookieFile(ctx context.Context, gitConfig *credentials.GitConfigSnapshot) (string, error) {
+	outputFile, err := credentials.WithEnvOverrides(gitConfig).PathConfig(ctx, "google.cookieFile")
 	if err != nil {
-		return fmt.Errorf("cannot read google.cookieFile in git-config: %v", err)
+		return "", fmt.Errorf("cannot read google.cookieFile in git-config: %v", err)
 	}
 	if outputFile == "" {
 		u, err := user.Current()
 		if err != nil {
-			return fmt.Errorf("cannot get the current user: %v", err)
+			return "", fmt.Errorf("cannot get the current user: %v", err)
 		}
 		outputFile = filepath.Join(u.HomeDir, ".git-credential-cache", "googlesource-cookieauth-cookie")
 	}
+	return outputFile, nil
+}
 
-	var w *os.File
-	if outputFile == "-" {
-		w = os.Stdout
-	} else {
-		if err := os.MkdirAll(filepath.Dir(outputFile), 0700); err != nil {
-			return fmt.Errorf("cannot create the output directory: %v", err)
-		}
-		w, err = os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+// explainConfigs prints the effective configs for each URL that the cookies
+// would be written for, where the values come from, and the cookies. No
+// token is obtained.
+func explainConfigs(ctx context.Context, w io.Writer) error {
+	gitConfig, err := readGitConfig(ctx)
+	if err != nil {
+		return err
+	}
+	urls, err := cookieURLs(ctx, gitConfig)
+	if err != nil {
+		return err
+	}
+	outputFile, err := cookieFile(ctx, gitConfig)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Cookie file: %s\n", outputFile)
+
+	for _, u := range urls {
+		e, err := credentials.ExplainCredentialConfig(ctx, gitConfig, u)
 		if err != nil {
-			return fmt.Errorf("cannot open the output file: %v", err)
+			return fmt.Errorf("cannot resolve the configs for %s: %w", u, err)
+		}
+		c := e.Config
+		fmt.Fprintf(w, "\n%s\n", u)
+		if c.Profile != "" {
+			fmt.Fprintf(w, "  profile:      %s\n", c.Profile)
+		}
+		for i, a := range c.Accounts {
+			fmt.Fprintf(w, "  account %d:    %s (kind: %s)\n", i+1, a, a.Kind)
+		}
+		fmt.Fprintf(w, "  scopes:       %s\n", strings.Join(c.Scopes, ", "))
+		if len(c.ServiceAccountDelegateEmails) > 0 {
+			fmt.Fprintf(w, "  delegates:    %s\n", strings.Join(c.ServiceAccountDelegateEmails, ", "))
+		}
+		if c.ImpersonationSource != "" {
+			fmt.Fprintf(w, "  impersonation source: %s\n", c.ImpersonationSource)
+		}
+		gcloudPath := c.GcloudPath
+		if gcloudPath == "" {
+			gcloudPath = "(gcloud in PATH)"
+		}
+		fmt.Fprintf(w, "  gcloud path:  %s\n", gcloudPath)
+		if c.GcloudConfiguration != "" {
+			fmt.Fprintf(w, "  gcloud configuration: %s\n", c.GcloudConfiguration)
+		}
+		if c.TokenType != "" {
+			fmt.Fprintf(w, "  token type:   %s\n", c.TokenType)
+		}
+		tokenCache := c.TokenCacheDir
+		if tokenCache == "" {
+			tokenCache = "(disabled)"
+		}
+		fmt.Fprintf(w, "  token cache:  %s\n", tokenCache)
+		// The cookies are made with an empty token only to show where they
+		// apply.
+		for _, cookie := range credentials.MakeCookiesFromConfig(c, &oauth2.Token{}) {
+			fmt.Fprintf(w, "  cookie:       %s domain=%s path=%s\n", cookie.Name, cookie.Domain, cookie.Path)
+		}
+		if len(e.Sources) == 0 {
+			fmt.Fprintf(w, "  sources:      (all defaults)\n")
+			continue
+		}
+		fmt.Fprintf(w, "  sources:\n")
+		for _, src := range e.Sources {
+			origin := src.Origin
+			if src.Line > 0 {
+				origin = fmt.Sprintf("%s:%d", origin, src.Line)
+			}
+			fmt.Fprintf(w, "    %s=%s\t%s\n", src.Key, src.Value, origin)
 		}
-		defer w.Close()
 	}
+	return nil
+}
 
-	fmt.Fprintf(w, "# Created by %s at %s\n", os.Args[0], time.Now().Format(time.RFC3339))
-	p := nscjar.Parser{}
-	for _, c := range cookies {
-		p.Marshal(w, c)
+// exitWithError logs the error with a hint on how to fix it, and exits with
+// the exit code for the error class.
+func exitWithError(msg string, err error) {
+	log.Printf("%s: %v", msg, err)
+	if hint := credentials.ErrorHint(err); hint != "" {
+		log.Print(hint)
 	}
-	return nil
+	os.Exit(credentials.ExitCode(err))
 }
 
 type StringList []string